@@ -0,0 +1,283 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/AudDMusic/audd-go"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var recognitionCacheBucket = []byte("recognition-cache")
+
+// The least recently used entries are removed from the memory when the cache grows past this size
+const maxCacheEntries = 10000
+
+// How often the expired entries are removed from the memory and the database
+const cacheCleanupInterval = time.Hour
+
+// Larger attachments aren't downloaded to be hashed
+const maxHashedAttachmentSize = 100 << 20
+
+var attachmentClient = &http.Client{Timeout: time.Second * 30}
+
+type cachedRecognition struct {
+	Result []audd.RecognitionEnterpriseResult `json:"result"`
+	Time   time.Time                          `json:"time"`
+}
+
+// CachingRecognizer returns earlier results for the same URL and time range instead of calling the next Recognizer
+// again, which often happens when several people ask about the same popular clip. Discord attachments are also
+// matched by the hash of their content, since the same file is often uploaded again and gets a different URL.
+// Files and recordings aren't cached, and neither are errors
+type CachingRecognizer struct {
+	Next Recognizer
+	TTL  time.Duration
+	// MaxEntries limits the entries kept in memory; the database isn't limited, since the entries there expire
+	MaxEntries int
+	// db is optional; with it, the cache survives restarts
+	db *bolt.DB
+	// entries points to the elements of recent, which are ordered from the most recently used
+	entries map[string]*list.Element
+	recent  *list.List
+	mu      sync.Mutex
+}
+
+type cacheElement struct {
+	Key   string
+	Entry cachedRecognition
+}
+
+func NewCachingRecognizer(next Recognizer, ttl time.Duration, db *bolt.DB) *CachingRecognizer {
+	return &CachingRecognizer{Next: next, TTL: ttl, MaxEntries: maxCacheEntries, db: db,
+		entries: map[string]*list.Element{}, recent: list.New()}
+}
+
+func (r *CachingRecognizer) RecognizeLongAudio(v interface{}, parameters map[string]string) ([]audd.RecognitionEnterpriseResult, error) {
+	link, isURL := v.(string)
+	if !isURL {
+		return r.Next.RecognizeLongAudio(v, parameters)
+	}
+	keys := []string{recognitionCacheKey(normalizeURL(link), parameters)}
+	if result, found := r.get(keys[0]); found {
+		fmt.Println("Got the result from the cache for", link)
+		return result, nil
+	}
+	if isDiscordAttachment(link) {
+		hash, err := hashAttachment(link)
+		if !capture(err) && hash != "" {
+			keys = append(keys, recognitionCacheKey("sha256:"+hash, parameters))
+			if result, found := r.get(keys[1]); found {
+				fmt.Println("Got the result from the cache for the same file as", link)
+				capture(r.set(keys[0], result))
+				return result, nil
+			}
+		}
+	}
+	result, err := r.Next.RecognizeLongAudio(v, parameters)
+	if err == nil {
+		for _, key := range keys {
+			capture(r.set(key, result))
+		}
+	}
+	return result, err
+}
+
+func (r *CachingRecognizer) get(key string) ([]audd.RecognitionEnterpriseResult, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var entry cachedRecognition
+	element, found := r.entries[key]
+	if found {
+		entry = element.Value.(*cacheElement).Entry
+	} else if r.db != nil {
+		err := r.db.View(func(tx *bolt.Tx) error {
+			v := tx.Bucket(recognitionCacheBucket).Get([]byte(key))
+			if v == nil {
+				return nil
+			}
+			found = true
+			return json.Unmarshal(v, &entry)
+		})
+		if capture(err) {
+			return nil, false
+		}
+		if found {
+			element = r.add(key, entry)
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	if time.Since(entry.Time) > r.TTL {
+		r.remove(element)
+		return nil, false
+	}
+	r.recent.MoveToFront(element)
+	return entry.Result, true
+}
+
+// add puts the entry in memory and removes the least recently used entries past MaxEntries; r.mu has to be held
+func (r *CachingRecognizer) add(key string, entry cachedRecognition) *list.Element {
+	if element, exists := r.entries[key]; exists {
+		element.Value.(*cacheElement).Entry = entry
+		r.recent.MoveToFront(element)
+		return element
+	}
+	element := r.recent.PushFront(&cacheElement{Key: key, Entry: entry})
+	r.entries[key] = element
+	for r.MaxEntries > 0 && r.recent.Len() > r.MaxEntries {
+		r.remove(r.recent.Back())
+	}
+	return element
+}
+
+func (r *CachingRecognizer) remove(element *list.Element) {
+	r.recent.Remove(element)
+	delete(r.entries, element.Value.(*cacheElement).Key)
+}
+
+func (r *CachingRecognizer) set(key string, result []audd.RecognitionEnterpriseResult) error {
+	entry := cachedRecognition{Result: result, Time: time.Now()}
+	r.mu.Lock()
+	r.add(key, entry)
+	r.mu.Unlock()
+	if r.db == nil {
+		return nil
+	}
+	v, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(recognitionCacheBucket).Put([]byte(key), v)
+	})
+}
+
+// RemoveExpired removes the expired entries from the memory and the database. Expired entries are never returned,
+// so this only frees the space
+func (r *CachingRecognizer) RemoveExpired() error {
+	r.mu.Lock()
+	for element := r.recent.Front(); element != nil; {
+		next := element.Next()
+		if time.Since(element.Value.(*cacheElement).Entry.Time) > r.TTL {
+			r.remove(element)
+		}
+		element = next
+	}
+	r.mu.Unlock()
+	if r.db == nil {
+		return nil
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(recognitionCacheBucket)
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var e cachedRecognition
+			if json.Unmarshal(v, &e) != nil || time.Since(e.Time) > r.TTL {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// removeExpiredEvery calls RemoveExpired periodically; it never returns
+func (r *CachingRecognizer) removeExpiredEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		capture(r.RemoveExpired())
+	}
+}
+
+// recognitionCacheKey is the normalized URL or the file hash with all the parameters, since any of them can change
+// the result
+func recognitionCacheKey(source string, parameters map[string]string) string {
+	keys := make([]string, 0, len(parameters))
+	for k := range parameters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	key := source
+	for _, k := range keys {
+		key += " " + k + "=" + parameters[k]
+	}
+	return key
+}
+
+// normalizeURL removes the parts of the link that don't change the audio: the fragment, tracking parameters,
+// and the expiring signatures Discord adds to attachment links
+func normalizeURL(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	if u.Host == "media.discordapp.net" {
+		u.Host = "cdn.discordapp.com"
+	}
+	query := u.Query()
+	for k := range query {
+		if strings.HasPrefix(k, "utm_") {
+			query.Del(k)
+		}
+	}
+	// t and start are already in skip_first_seconds, and si is a YouTube share ID
+	for _, k := range []string{"t", "time_continue", "start", "si", "feature"} {
+		query.Del(k)
+	}
+	if u.Host == "cdn.discordapp.com" {
+		for _, k := range []string{"ex", "is", "hm"} {
+			query.Del(k)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func isDiscordAttachment(link string) bool {
+	return strings.HasPrefix(link, "https://cdn.discordapp.com/attachments/") ||
+		strings.HasPrefix(link, "https://media.discordapp.net/attachments/")
+}
+
+// hashAttachment returns the SHA-256 of the file, or an empty string if it's too large
+func hashAttachment(link string) (string, error) {
+	resp, err := attachmentClient.Get(link)
+	if err != nil {
+		return "", err
+	}
+	defer captureFunc(resp.Body.Close)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("got %s when downloading %s", resp.Status, link)
+	}
+	if resp.ContentLength > maxHashedAttachmentSize {
+		return "", nil
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, io.LimitReader(resp.Body, maxHashedAttachmentSize+1))
+	if err != nil {
+		return "", err
+	}
+	if n > maxHashedAttachmentSize {
+		return "", nil
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
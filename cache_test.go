@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func cachedKeys(r *CachingRecognizer) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]string, 0, r.recent.Len())
+	for element := r.recent.Front(); element != nil; element = element.Next() {
+		keys = append(keys, element.Value.(*cacheElement).Key)
+	}
+	return keys
+}
+
+func TestCachingRecognizerEvictsLeastRecentlyUsed(t *testing.T) {
+	recognizer := &FakeRecognizer{}
+	r := NewCachingRecognizer(recognizer, time.Hour, nil)
+	r.MaxEntries = 2
+	for _, link := range []string{"https://example.com/a", "https://example.com/b", "https://example.com/a",
+		"https://example.com/c", "https://example.com/a", "https://example.com/b"} {
+		if _, err := r.RecognizeLongAudio(link, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// b was dropped when c was added, since a was used after it
+	if len(recognizer.Requests) != 4 || recognizer.Requests[3].Source != "https://example.com/b" {
+		t.Errorf("got requests %v", recognizer.Requests)
+	}
+	if keys := cachedKeys(r); len(keys) != 2 || keys[0] != "https://example.com/b" || keys[1] != "https://example.com/a" {
+		t.Errorf("got %q in the cache", keys)
+	}
+}
+
+func TestCachingRecognizerRemoveExpired(t *testing.T) {
+	db := openTestDatabase(t, filepath.Join(t.TempDir(), "cache.db"))
+	r := NewCachingRecognizer(&FakeRecognizer{}, time.Hour, db)
+	for _, key := range []string{"old", "new"} {
+		if err := r.set(key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old, err := json.Marshal(cachedRecognition{Time: time.Now().Add(-2 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(recognitionCacheBucket).Put([]byte("old"), old)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.entries["old"].Value.(*cacheElement).Entry.Time = time.Now().Add(-2 * time.Hour)
+
+	if err := r.RemoveExpired(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := cachedKeys(r); len(keys) != 1 || keys[0] != "new" {
+		t.Errorf("got %q in memory after removing the expired entries", keys)
+	}
+	var stored []string
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(recognitionCacheBucket).ForEach(func(k, _ []byte) error {
+			stored = append(stored, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || stored[0] != "new" {
+		t.Errorf("got %q in the database after removing the expired entries", stored)
+	}
+}
@@ -4,7 +4,6 @@ go 1.17
 
 require (
 	github.com/AudDMusic/audd-go v0.2.4
-	github.com/Mihonarium/dgvoice v0.0.0-20220113090652-9316b54c4d22
 	github.com/Mihonarium/discordgo v0.23.3
 	github.com/Mihonarium/go-profanity v0.0.0-20220116125849-662cde2e1ad4
 	github.com/cryptix/wav v0.0.0-20180415113528-8bdace674401
@@ -12,6 +11,8 @@ require (
 	github.com/kodova/html-to-markdown v1.0.1
 	github.com/orcaman/writerseeker v0.0.0-20200621085525-1d3f536ff85e
 	github.com/youpy/go-wav v0.3.0
+	go.etcd.io/bbolt v1.3.6
+	layeh.com/gopus v0.0.0-20210501142526-1ee02d434e32
 	mvdan.cc/xurls/v2 v2.3.0
 )
 
@@ -25,5 +26,4 @@ require (
 	github.com/zaf/g711 v0.0.0-20190814101024-76a4a538f52b // indirect
 	golang.org/x/crypto v0.0.0-20220112180741-5e0467b6c7ce // indirect
 	golang.org/x/sys v0.0.0-20220111092808-5a964db01320 // indirect
-	layeh.com/gopus v0.0.0-20210501142526-1ee02d434e32 // indirect
 )
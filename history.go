@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/AudDMusic/audd-go"
+	"github.com/Mihonarium/discordgo"
+	bolt "go.etcd.io/bbolt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The history bucket has a bucket for each server, so the queries only read the entries from one server
+var historyBucket = []byte("history")
+
+// The history of the direct messages is kept in this bucket instead of a server's
+var directMessagesHistoryBucket = []byte("direct messages")
+
+// RecognitionSource describes where a recognition request came from, so the results can be stored in the history
+type RecognitionSource struct {
+	GuildID        string
+	ChannelID      string
+	UserID         string
+	URL            string
+	VoiceChannelID string
+}
+
+type HistoryEntry struct {
+	ID             uint64    `json:"id"`
+	GuildID        string    `json:"guild_id"`
+	ChannelID      string    `json:"channel_id"`
+	UserID         string    `json:"user_id"`
+	URL            string    `json:"url,omitempty"`
+	VoiceChannelID string    `json:"voice_channel_id,omitempty"`
+	Artist         string    `json:"artist"`
+	Title          string    `json:"title"`
+	Album          string    `json:"album,omitempty"`
+	SongLink       string    `json:"song_link,omitempty"`
+	Score          int       `json:"score"`
+	Timecode       string    `json:"timecode,omitempty"`
+	Time           time.Time `json:"time"`
+}
+
+type HistoryStore struct {
+	db *bolt.DB
+}
+
+var History *HistoryStore
+
+func openDatabase(file string) (*bolt.DB, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{historyBucket, guildSettingsBucket, recognitionCacheBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return migrateHistory(tx.Bucket(historyBucket))
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func NewHistoryStore(db *bolt.DB) *HistoryStore {
+	return &HistoryStore{db: db}
+}
+
+func guildHistoryBucket(guildID string) []byte {
+	if guildID == "" {
+		return directMessagesHistoryBucket
+	}
+	return []byte(guildID)
+}
+
+// migrateHistory moves the entries stored directly in the history bucket by the older versions to the servers' buckets
+func migrateHistory(b *bolt.Bucket) error {
+	var keys [][]byte
+	var entries []HistoryEntry
+	// The bucket can't be changed while it's iterated over, so the entries are moved after reading them
+	cur := b.Cursor()
+	for k, v := cur.First(); k != nil; k, v = cur.Next() {
+		// The values of the servers' buckets are nil
+		if v == nil {
+			continue
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return fmt.Errorf("can't decode the history entry %d: %v", binary.BigEndian.Uint64(k), err)
+		}
+		keys = append(keys, append([]byte{}, k...))
+		entries = append(entries, entry)
+	}
+	for i, entry := range entries {
+		guild, err := b.CreateBucketIfNotExists(guildHistoryBucket(entry.GuildID))
+		if err != nil {
+			return err
+		}
+		if entry.ID, err = guild.NextSequence(); err != nil {
+			return err
+		}
+		v, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := guild.Put(historyKey(entry.ID), v); err != nil {
+			return err
+		}
+		if err := b.Delete(keys[i]); err != nil {
+			return err
+		}
+	}
+	if len(entries) > 0 {
+		fmt.Println("Moved", len(entries), "history entries to the servers' buckets")
+	}
+	return nil
+}
+
+// Add saves the songs recognized for the source. Keys are sequential for each server, so the entries are stored
+// in chronological order
+func (h *HistoryStore) Add(source *RecognitionSource, songs []audd.RecognitionResult) error {
+	if h == nil || source == nil || len(songs) == 0 {
+		return nil
+	}
+	now := time.Now()
+	return h.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(historyBucket).CreateBucketIfNotExists(guildHistoryBucket(source.GuildID))
+		if err != nil {
+			return err
+		}
+		for _, song := range songs {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			entry := HistoryEntry{
+				ID:             id,
+				GuildID:        source.GuildID,
+				ChannelID:      source.ChannelID,
+				UserID:         source.UserID,
+				URL:            source.URL,
+				VoiceChannelID: source.VoiceChannelID,
+				Artist:         song.Artist,
+				Title:          song.Title,
+				Album:          song.Album,
+				SongLink:       song.SongLink,
+				Score:          song.Score,
+				Timecode:       song.Timecode,
+				Time:           now,
+			}
+			v, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(historyKey(id), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForEach calls f for every entry stored for the server (or the direct messages if guildID is empty),
+// starting with the most recent one, until f returns false
+func (h *HistoryStore) ForEach(guildID string, f func(entry *HistoryEntry) bool) error {
+	if h == nil {
+		return nil
+	}
+	return h.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket).Bucket(guildHistoryBucket(guildID))
+		if b == nil {
+			return nil
+		}
+		cur := b.Cursor()
+		for k, v := cur.Last(); k != nil; k, v = cur.Prev() {
+			var entry HistoryEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("can't decode the history entry %d: %v", binary.BigEndian.Uint64(k), err)
+			}
+			if !f(&entry) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func historyKey(id uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b
+}
+
+type HistoryFilter struct {
+	GuildID   string
+	ChannelID string
+	UserID    string
+	From      time.Time
+	To        time.Time
+	MinScore  int
+}
+
+func (f *HistoryFilter) Match(entry *HistoryEntry) bool {
+	if f.GuildID != "" && entry.GuildID != f.GuildID {
+		return false
+	}
+	if f.ChannelID != "" && entry.ChannelID != f.ChannelID {
+		return false
+	}
+	if f.UserID != "" && entry.UserID != f.UserID {
+		return false
+	}
+	if !f.From.IsZero() && entry.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !entry.Time.Before(f.To) {
+		return false
+	}
+	return entry.Score >= f.MinScore
+}
+
+// Query returns up to limit most recent entries from the filter's server matching the filter after skipping offset
+// of them, and whether there are more entries to show
+func (h *HistoryStore) Query(filter HistoryFilter, offset, limit int) (entries []HistoryEntry, more bool, err error) {
+	entries = make([]HistoryEntry, 0, limit)
+	skipped := 0
+	err = h.ForEach(filter.GuildID, func(entry *HistoryEntry) bool {
+		if !filter.Match(entry) {
+			return true
+		}
+		if skipped < offset {
+			skipped++
+			return true
+		}
+		if len(entries) == limit {
+			more = true
+			return false
+		}
+		entries = append(entries, *entry)
+		return true
+	})
+	return
+}
+
+const historyPageSize = 10
+
+var historyCommand = &discordgo.ApplicationCommand{
+	Type:        discordgo.ChatApplicationCommand,
+	Name:        "history",
+	Description: "Show the songs recently recognized on this server",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "scope",
+			Description: "Whose recognitions to show",
+			Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "This server", Value: "guild"},
+				{Name: "This channel", Value: "channel"},
+				{Name: "Only mine", Value: "me"},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionUser,
+			Name:        "user",
+			Description: "Only show songs recognized for this user",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "from",
+			Description: "Only show songs recognized on or after this date (YYYY-MM-DD)",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "to",
+			Description: "Only show songs recognized on or before this date (YYYY-MM-DD)",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionInteger,
+			Name:        "min-score",
+			Description: "Only show songs matched with at least this score",
+		},
+	},
+}
+
+func (c *BotConfig) HistoryCommand(s Session, i *discordgo.InteractionCreate) {
+	if i.GuildID == "" {
+		capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "Sorry, the history is only available on servers",
+				Flags:   1 << 6,
+			},
+		}))
+		return
+	}
+	filter := HistoryFilter{GuildID: i.GuildID}
+	var err error
+	for _, option := range i.ApplicationCommandData().Options {
+		switch option.Name {
+		case "scope":
+			switch option.StringValue() {
+			case "channel":
+				filter.ChannelID = i.ChannelID
+			case "me":
+				filter.UserID = interactionUserID(i)
+			}
+		case "user":
+			filter.UserID = option.Value.(string)
+		case "from":
+			filter.From, err = time.Parse("2006-01-02", option.StringValue())
+		case "to":
+			filter.To, err = time.Parse("2006-01-02", option.StringValue())
+			filter.To = filter.To.AddDate(0, 0, 1)
+		case "min-score":
+			filter.MinScore = int(option.IntValue())
+		}
+		if err != nil {
+			capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: "Sorry, I couldn't understand the date. Please use the YYYY-MM-DD format, e.g., 2022-01-31",
+					Flags:   1 << 6,
+				},
+			}))
+			return
+		}
+	}
+	capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: historyPage(filter, 0),
+	}))
+}
+
+// HistoryButton handles the previous/next buttons; the filter and the page are stored in the custom ID
+func (c *BotConfig) HistoryButton(s Session, i *discordgo.InteractionCreate) {
+	filter, page, err := parseHistoryCustomID(i.MessageComponentData().CustomID)
+	if capture(err) {
+		return
+	}
+	// The guild always comes from the interaction so the buttons can't be used to see other servers' history
+	filter.GuildID = i.GuildID
+	capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: historyPage(filter, page),
+	}))
+}
+
+func historyPage(filter HistoryFilter, page int) *discordgo.InteractionResponseData {
+	entries, more, err := History.Query(filter, page*historyPageSize, historyPageSize)
+	if capture(err) {
+		return &discordgo.InteractionResponseData{
+			Content: "Sorry, I couldn't read the history",
+		}
+	}
+	if len(entries) == 0 {
+		return &discordgo.InteractionResponseData{
+			Content:    "I haven't recognized any songs matching this yet",
+			Components: []discordgo.MessageComponent{},
+		}
+	}
+	lines := make([]string, 0, len(entries))
+	for j, entry := range entries {
+		line := fmt.Sprintf("`%d.` **%s** by %s", page*historyPageSize+j+1, entry.Title, entry.Artist)
+		if entry.SongLink != "" {
+			line = fmt.Sprintf("`%d.` [**%s** by %s](%s)", page*historyPageSize+j+1, entry.Title, entry.Artist, entry.SongLink)
+		}
+		line += fmt.Sprintf("\n<t:%d:R> for <@%s> in <#%s>, matched: `%d%%`",
+			entry.Time.Unix(), entry.UserID, entry.ChannelID, entry.Score)
+		lines = append(lines, line)
+	}
+	return &discordgo.InteractionResponseData{
+		Embeds: []*discordgo.MessageEmbed{{
+			Title:       "Recently recognized songs",
+			Description: strings.Join(lines, "\n\n"),
+			Color:       3066993,
+			Footer:      &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("Page %d", page+1)},
+		}},
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+		Components: []discordgo.MessageComponent{&discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{
+				Label: "Previous", Style: discordgo.SecondaryButton, Emoji: discordgo.ComponentEmoji{Name: "⬅️"},
+				CustomID: historyCustomID(filter, page-1), Disabled: page == 0,
+			},
+			discordgo.Button{
+				Label: "Next", Style: discordgo.SecondaryButton, Emoji: discordgo.ComponentEmoji{Name: "➡️"},
+				CustomID: historyCustomID(filter, page+1), Disabled: !more,
+			},
+		}}},
+	}
+}
+
+// historyCustomID encodes the page and the filter (without the guild) in under 100 characters
+func historyCustomID(filter HistoryFilter, page int) string {
+	var from, to int64
+	if !filter.From.IsZero() {
+		from = filter.From.Unix()
+	}
+	if !filter.To.IsZero() {
+		to = filter.To.Unix()
+	}
+	return fmt.Sprintf("history:%d:%s:%s:%d:%d:%d", page, filter.ChannelID, filter.UserID, from, to, filter.MinScore)
+}
+
+func parseHistoryCustomID(customID string) (filter HistoryFilter, page int, err error) {
+	parts := strings.Split(customID, ":")
+	if len(parts) != 7 || parts[0] != "history" {
+		return filter, 0, fmt.Errorf("unexpected history custom ID %s", customID)
+	}
+	numbers := make([]int64, 0, 4)
+	for _, part := range []string{parts[1], parts[4], parts[5], parts[6]} {
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return filter, 0, err
+		}
+		numbers = append(numbers, n)
+	}
+	page = int(numbers[0])
+	filter.ChannelID = parts[2]
+	filter.UserID = parts[3]
+	if numbers[1] != 0 {
+		filter.From = time.Unix(numbers[1], 0)
+	}
+	if numbers[2] != 0 {
+		filter.To = time.Unix(numbers[2], 0)
+	}
+	filter.MinScore = int(numbers[3])
+	return
+}
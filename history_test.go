@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/AudDMusic/audd-go"
+	bolt "go.etcd.io/bbolt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestDatabase(t *testing.T, file string) *bolt.DB {
+	db, err := openDatabase(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func historyTitles(t *testing.T, h *HistoryStore, filter HistoryFilter, offset, limit int) ([]string, bool) {
+	entries, more, err := h.Query(filter, offset, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		titles = append(titles, entry.Title)
+	}
+	return titles, more
+}
+
+func TestHistoryQuery(t *testing.T) {
+	h := NewHistoryStore(openTestDatabase(t, filepath.Join(t.TempDir(), "history.db")))
+	add := func(guildID, channelID, title string) {
+		err := h.Add(&RecognitionSource{GuildID: guildID, ChannelID: channelID, UserID: testUserID},
+			[]audd.RecognitionResult{{Artist: "Artist", Title: title, Score: 100}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("a", "a1", "First")
+	add("b", "b1", "Other server")
+	add("a", "a2", "Second")
+	add("", "dm", "Direct message")
+	add("a", "a1", "Third")
+
+	tests := []struct {
+		name          string
+		filter        HistoryFilter
+		offset, limit int
+		want          []string
+		more          bool
+	}{
+		{"the server", HistoryFilter{GuildID: "a"}, 0, 10, []string{"Third", "Second", "First"}, false},
+		{"the first page", HistoryFilter{GuildID: "a"}, 0, 2, []string{"Third", "Second"}, true},
+		{"the second page", HistoryFilter{GuildID: "a"}, 2, 2, []string{"First"}, false},
+		{"the channel", HistoryFilter{GuildID: "a", ChannelID: "a1"}, 0, 10, []string{"Third", "First"}, false},
+		{"another server", HistoryFilter{GuildID: "b"}, 0, 10, []string{"Other server"}, false},
+		{"a server without history", HistoryFilter{GuildID: "c"}, 0, 10, []string{}, false},
+		{"the direct messages", HistoryFilter{}, 0, 10, []string{"Direct message"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			titles, more := historyTitles(t, h, tt.filter, tt.offset, tt.limit)
+			if len(titles) != len(tt.want) || more != tt.more {
+				t.Fatalf("got %q, more: %t; want %q, more: %t", titles, more, tt.want, tt.more)
+			}
+			for i := range titles {
+				if titles[i] != tt.want[i] {
+					t.Fatalf("got %q, want %q", titles, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHistoryMigration(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.db")
+	db, err := bolt.Open(file, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The older versions kept the entries from all the servers in the history bucket
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(historyBucket)
+		if err != nil {
+			return err
+		}
+		for i, entry := range []HistoryEntry{
+			{GuildID: "a", Title: "First"},
+			{GuildID: "b", Title: "Other server"},
+			{GuildID: "a", Title: "Second"},
+		} {
+			entry.ID, entry.Time = uint64(i+1), time.Now()
+			v, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(historyKey(entry.ID), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHistoryStore(openTestDatabase(t, file))
+	if titles, _ := historyTitles(t, h, HistoryFilter{GuildID: "a"}, 0, 10); len(titles) != 2 ||
+		titles[0] != "Second" || titles[1] != "First" {
+		t.Errorf("got %q from the first server after the migration", titles)
+	}
+	if titles, _ := historyTitles(t, h, HistoryFilter{GuildID: "b"}, 0, 10); len(titles) != 1 {
+		t.Errorf("got %q from the second server after the migration", titles)
+	}
+	err = h.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyBucket).ForEach(func(k, v []byte) error {
+			if v != nil {
+				t.Errorf("the entry %x wasn't moved", k)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
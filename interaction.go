@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Mihonarium/discordgo"
+	"sync"
+	"time"
+)
+
+// Discord needs a response within 3 seconds, and the interaction token is valid for 15 minutes; the commands
+// that don't reply in this time get an error instead
+const interactionTimeout = 2 * time.Minute
+
+// The commands that keep updating the response can do it until the interaction token expires
+const longInteractionTimeout = 14 * time.Minute
+
+var longCommands = map[string]bool{"recognize-mix": true}
+
+const ephemeralFlag = 1 << 6
+
+// Only the person who used these commands sees the replies
+var ephemeralCommands = map[string]bool{"settings": true}
+
+// The results of these commands are only shown to the person who asked if they choose the private option,
+// or if the server shows the results privately by default
+var privateResultCommands = map[string]bool{"song-vc": true, "recognize": true, "Recognize This Song": true}
+
+// privateResults is whether only the person who used the command should see the results
+func (c *BotConfig) privateResults(i *discordgo.InteractionCreate) bool {
+	data := i.ApplicationCommandData()
+	if !privateResultCommands[data.Name] {
+		return false
+	}
+	for _, option := range data.Options {
+		if option.Name == "private" {
+			return option.BoolValue()
+		}
+	}
+	return c.PrivateResults
+}
+
+// deferredSession is the session for a command acknowledged with a deferred response. The handlers reply with
+// InteractionRespond as usual, and the reply edits the deferred response
+type deferredSession struct {
+	Session
+	appID       string
+	interaction *discordgo.Interaction
+	ephemeral   bool
+
+	mu        sync.Mutex
+	responded bool
+	timedOut  bool
+}
+
+// deferInteraction acknowledges the interaction, so the handler has as long as it needs to reply
+func deferInteraction(s Session, appID string, interaction *discordgo.Interaction, ephemeral bool) (*deferredSession, error) {
+	data := &discordgo.InteractionResponseData{}
+	if ephemeral {
+		data.Flags = ephemeralFlag
+	}
+	err := s.InteractionRespond(interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &deferredSession{Session: s, appID: appID, interaction: interaction, ephemeral: ephemeral}, nil
+}
+
+func (s *deferredSession) InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse) error {
+	if interaction.ID != s.interaction.ID || resp.Type != discordgo.InteractionResponseChannelMessageWithSource {
+		return s.Session.InteractionRespond(interaction, resp)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timedOut {
+		return fmt.Errorf("the response to the interaction %s came after it timed out", interaction.ID)
+	}
+	s.responded = true
+	data := resp.Data
+	if data == nil {
+		data = &discordgo.InteractionResponseData{}
+	}
+	if data.Flags&ephemeralFlag != 0 && !s.ephemeral {
+		// The deferred response is public and can't be made ephemeral, so it's replaced with an ephemeral followup
+		capture(s.Session.InteractionResponseDelete(s.appID, interaction))
+		_, err := s.Session.FollowupMessageCreate(s.appID, interaction, true, &discordgo.WebhookParams{
+			Content:         data.Content,
+			Components:      data.Components,
+			Embeds:          data.Embeds,
+			Files:           data.Files,
+			AllowedMentions: data.AllowedMentions,
+			Flags:           ephemeralFlag,
+		})
+		return err
+	}
+	_, err := s.Session.InteractionResponseEdit(s.appID, interaction, &discordgo.WebhookEdit{
+		Content:         data.Content,
+		Components:      data.Components,
+		Embeds:          data.Embeds,
+		Files:           data.Files,
+		AllowedMentions: data.AllowedMentions,
+	})
+	return err
+}
+
+func (s *deferredSession) InteractionResponseEdit(appID string, interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit) (*discordgo.Message, error) {
+	if interaction.ID != s.interaction.ID {
+		return s.Session.InteractionResponseEdit(appID, interaction, newresp)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timedOut {
+		return nil, fmt.Errorf("the response to the interaction %s came after it timed out", interaction.ID)
+	}
+	s.responded = true
+	return s.Session.InteractionResponseEdit(appID, interaction, newresp)
+}
+
+// timeOut replaces the deferred response with an error if the handler hasn't replied yet. After it, the handler
+// can't reply or edit the response anymore
+func (s *deferredSession) timeOut() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timedOut = true
+	if s.responded {
+		return
+	}
+	_, err := s.Session.InteractionResponseEdit(s.appID, s.interaction, &discordgo.WebhookEdit{
+		Content: "Sorry, it's taking too long. Please try again later",
+	})
+	capture(err)
+}
+
+// finish removes the deferred response if the handler returned without replying
+func (s *deferredSession) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.responded && !s.timedOut {
+		capture(s.Session.InteractionResponseDelete(s.appID, s.interaction))
+	}
+}
+
+// handleCommand defers the response, runs the handler, and replies with an error if the handler takes too long
+func (c *BotConfig) handleCommand(s Session, i *discordgo.InteractionCreate,
+	h func(c *BotConfig, s Session, i *discordgo.InteractionCreate)) {
+	name := i.ApplicationCommandData().Name
+	timeout := interactionTimeout
+	if longCommands[name] {
+		timeout = longInteractionTimeout
+	}
+	ds, err := deferInteraction(s, c.DiscordAppID, i.Interaction, ephemeralCommands[name] || c.privateResults(i))
+	if capture(err) {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h(c, ds, i)
+	}()
+	select {
+	case <-done:
+		ds.finish()
+	case <-time.After(timeout):
+		fmt.Println("The command", name, "timed out")
+		ds.timeOut()
+	}
+}
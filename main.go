@@ -9,6 +9,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/kodova/html-to-markdown/escape"
 	_ "github.com/youpy/go-wav"
+	bolt "go.etcd.io/bbolt"
 	"io"
 	"mvdan.cc/xurls/v2"
 	"net/http"
@@ -25,46 +26,73 @@ const release = "discord-bot@0.0.4"
 const configFile = "config.json"
 
 type BotConfig struct {
-	AudDToken               string   `required:"true" default:"test" usage:"the token from dashboard.audd.io" json:"AudDToken"`
-	DiscordToken            string   `required:"true" default:"test" usage:"the secret from https://discordapp.com/developers/applications" json:"DiscordToken"`
-	DiscordAppID            string   `usage:"the application id from https://discordapp.com/developers/applications" json:"DiscordAppID"`
-	Triggers                []string `usage:"phrases bot will react to" json:"Triggers"`
-	AntiTriggers            []string `usage:"phrases bot will avoid replying to" json:"AudDTAntiTriggers"`
-	MaxTriggerTextLength    int      `json:"MaxTriggerTextLength"`
-	PatreonSupporters       []string `json:"patreon_supporters"`
-	SecretCallbackToken     string   `json:"SecretCallbackToken"`
-	CallbacksAddr           string   `json:"CallbacksAddr"`
-	MaxReplyDepth           int      `json:"MaxReplyDepth"`
-	MinScore                int      `json:"MinScore"`
-	UncompressedLimit       int      `usage:"the maximum amount of songs to post as large embeds" json:"UncompressedLimit"`
-	CompressStartingWith    int      `usage:"the first result to compress when compressing" json:"CompressStartingWith"`
-	CanCompressWithoutSlash bool     `usage:"whether can send compressed messages in responses not to usual text" json:"CanCompressWithoutSlash"`
-	SentryDSN               string   `default:"" usage:"add a Sentry DSN to capture errors" json:"SentryDSN"`
+	AudDToken               string        `required:"true" default:"test" usage:"the token from dashboard.audd.io" json:"AudDToken"`
+	DiscordToken            string        `required:"true" default:"test" usage:"the secret from https://discordapp.com/developers/applications" json:"DiscordToken"`
+	DiscordAppID            string        `usage:"the application id from https://discordapp.com/developers/applications" json:"DiscordAppID"`
+	Triggers                []TriggerRule `usage:"phrases bot will react to" json:"Triggers"`
+	AntiTriggers            []TriggerRule `usage:"phrases bot will avoid replying to" json:"AntiTriggers"`
+	MaxTriggerTextLength    int           `json:"MaxTriggerTextLength"`
+	PatreonSupporters       []string      `json:"patreon_supporters"`
+	SecretCallbackToken     string        `json:"SecretCallbackToken"`
+	CallbacksAddr           string        `json:"CallbacksAddr"`
+	MaxReplyDepth           int           `json:"MaxReplyDepth"`
+	MinScore                int           `json:"MinScore"`
+	UncompressedLimit       int           `usage:"the maximum amount of songs to post as large embeds" json:"UncompressedLimit"`
+	CompressStartingWith    int           `usage:"the first result to compress when compressing" json:"CompressStartingWith"`
+	CanCompressWithoutSlash bool          `usage:"whether can send compressed messages in responses not to usual text" json:"CanCompressWithoutSlash"`
+	SentryDSN               string        `default:"" usage:"add a Sentry DSN to capture errors" json:"SentryDSN"`
+	DatabaseFile            string        `default:"discordBot.db" usage:"the file to store the recognition history and server settings in" json:"DatabaseFile"`
+	RecordSeconds           int           `default:"12" usage:"how many seconds of audio to record from voice channels" json:"RecordSeconds"`
+	RecognizerBackend       string        `default:"audd" usage:"audd to use the AudD API or fake to return results from FakeRecognizerFixtures" json:"RecognizerBackend"`
+	FakeRecognizerFixtures  string        `usage:"the JSON file with results for the fake recognizer" json:"FakeRecognizerFixtures"`
+	CacheTTLMinutes         int           `default:"1440" usage:"how long to reuse the results for the same link; -1 disables the cache" json:"CacheTTLMinutes"`
+	PersistCache            bool          `usage:"whether to keep the cached results in the database between restarts" json:"PersistCache"`
+
+	UserRateLimit    RateLimit `usage:"how many recognitions a user can request" json:"UserRateLimit"`
+	ChannelRateLimit RateLimit `usage:"how many recognitions can be requested in a channel" json:"ChannelRateLimit"`
+	GuildRateLimit   RateLimit `usage:"how many recognitions can be requested on a server" json:"GuildRateLimit"`
+
+	RecognizeAllLinks       bool `usage:"whether to recognize every link from a message instead of the first one" json:"RecognizeAllLinks"`
+	MaxLinksPerMessage      int  `default:"5" usage:"how many links from a message to recognize, up to 10" json:"MaxLinksPerMessage"`
+	MaxParallelRecognitions int  `default:"3" usage:"how many links from a message to recognize at the same time" json:"MaxParallelRecognitions"`
+	ScanRecentMessages      int  `default:"20" usage:"how many messages to look through for media when !song has nothing to recognize; -1 disables it" json:"ScanRecentMessages"`
+	MaxMixMinutes           int  `default:"60" usage:"how many minutes of a file !song full and /recognize-mix scan; -1 disables them" json:"MaxMixMinutes"`
+	PrivateResults          bool `usage:"whether to show the results of /song-vc, /recognize and the context menu only to the person who asked by default" json:"PrivateResults"`
+
+	Recognizer Recognizer `json:"-"`
+	// defaults is the global config a server's config is made from
+	defaults *BotConfig
 }
 
 var dSession *discordgo.Session
 var dSessionMu sync.Mutex
 var dg *discordgo.Session
-var AudDClient *audd.Client
 
 const enterpriseChunkLength = 12
 
-//ToDo: make a good help message
-var help = "👋 Hi! I'm a music recognition bot.\n\n" +
-	"If you see an audio or a video and want to know what's the music, you can reply to it with **!song**, and the " +
-	"bot will identify the music. Or make a right click on the message and pick Apps -> Recognize This Song.\n\n" +
-	"When you're on a voice channel and someone is playing music there, type the slash **/song-vc [mention]** command, " +
-	"mentioning the user playing the music (**!song [mention]** also works). The bot will record the sound for 12 seconds and then attempt to " +
-	"identify the song.\n\n" +
-	"On a voice channel, you can also use the slash **/listen** command (or **!listen**), and the bot will join the VC, " +
-	"listen, and keep the last 12 seconds " +
-	"of audio in it's memory, and when you type **/song-vc [mention]** (or **!song [mention]**), it will immediately identify music from the last 12 " +
-	"seconds of what the mentioned user or bot has played on the voice channel. If you send **/disconnect**, the bot will leave the VC.\n\n" +
-	"Source code: https://github.com/AudDMusic/DiscordBot. Privacy policy: https://audd.io/privacy.\n\n" +
-	"**I'm still in testing** and might restart from time to time. The commands are subject to change. " +
-	"Please report any bugs if you experience them. Support server: https://discord.gg/audd"
+// The most chunks recognized for "last N seconds"
+const maxLastChunks = 5
 
-// ToDo: move from converting to PCM and stacking to directly recording OPUS? E.g., something like https://github.com/bwmarrin/dca or https://github.com/jonas747/dca
+//ToDo: make a good help message
+func helpMessage(recordSeconds int) string {
+	return "👋 Hi! I'm a music recognition bot.\n\n" +
+		"If you see an audio or a video and want to know what's the music, you can reply to it with **!song**, and the " +
+		"bot will identify the music. Or make a right click on the message and pick Apps -> Recognize This Song. " +
+		"You can also send a link or a file with the slash **/recognize** command.\n\n" +
+		"When you're on a voice channel and someone is playing music there, type the slash **/song-vc [mention]** command, " +
+		"mentioning the user playing the music (**!song [mention]** also works). The bot will record the sound for " +
+		strconv.Itoa(recordSeconds) + " seconds and then attempt to identify the song. If you don't mention anyone, " +
+		"the bot will try to detect who is playing music.\n\n" +
+		"On a voice channel, you can also use the slash **/listen** command (or **!listen**), and the bot will join the VC, " +
+		"listen, and keep the last " + strconv.Itoa(recordSeconds) + " seconds " +
+		"of audio in it's memory, and when you type **/song-vc [mention]** (or **!song [mention]**), it will immediately identify music from the last " +
+		strconv.Itoa(recordSeconds) + " seconds of what the mentioned user or bot has played on the voice channel. " +
+		"If you send **/disconnect**, the bot will leave the VC.\n\n" +
+		"To find a song recognized earlier, use the slash **/history** command.\n\n" +
+		"Source code: https://github.com/AudDMusic/DiscordBot. Privacy policy: https://audd.io/privacy.\n\n" +
+		"**I'm still in testing** and might restart from time to time. The commands are subject to change. " +
+		"Please report any bugs if you experience them. Support server: https://discord.gg/audd"
+}
 
 func main() {
 	cfg, err := loadConfig(configFile)
@@ -88,11 +116,26 @@ func main() {
 			sentry.Flush(time.Second * 5)
 		}
 	}()
-	AudDClient = audd.NewClient(cfg.AudDToken)
-	AudDClient.SetEndpoint(audd.EnterpriseAPIEndpoint)
+	cfg.Recognizer, err = newRecognizer(cfg)
+	if err != nil {
+		panic(err)
+	}
+	db, err := openDatabase(cfg.DatabaseFile)
 	if err != nil {
 		panic(err)
 	}
+	defer captureFunc(db.Close)
+	if cfg.CacheTTLMinutes > 0 {
+		var cacheDB *bolt.DB
+		if cfg.PersistCache {
+			cacheDB = db
+		}
+		cache := NewCachingRecognizer(cfg.Recognizer, time.Minute*time.Duration(cfg.CacheTTLMinutes), cacheDB)
+		go cache.removeExpiredEvery(cacheCleanupInterval)
+		cfg.Recognizer = cache
+	}
+	History = NewHistoryStore(db)
+	Settings = NewSettingsStore(db)
 	dSessionMu.Lock() // Unlocks in the goroutine
 	go func() {
 		dg, err = discordgo.New("Bot " + cfg.DiscordToken)
@@ -105,9 +148,17 @@ func main() {
 		go func() {
 			dg.AddHandler(cfg.ready)
 			dg.AddHandler(cfg.resumed)
-			dg.AddHandler(cfg.messageCreate)
-			dg.AddHandler(cfg.guildCreate)
-			dg.AddHandler(cfg.interactionCreate)
+			dg.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+				cfg.messageCreate(discordSession{s}, m)
+			})
+			dg.AddHandler(func(s *discordgo.Session, event *discordgo.GuildCreate) {
+				cfg.guildCreate(discordSession{s}, event)
+			})
+			dg.AddHandler(func(s *discordgo.Session, e *discordgo.Event) {
+				if e.Type == "INTERACTION_CREATE" {
+					cfg.interactionEvent(discordSession{s}, e)
+				}
+			})
 		}()
 		dSession = dg
 		dSessionMu.Unlock() // Unlocks the outside lock so the callback server can start
@@ -158,7 +209,7 @@ type serverStats struct {
 var serverStatsList = make([]serverStats, 0)
 var serverStatsMu = &sync.RWMutex{}
 
-func (c *BotConfig) guildCreate(s *discordgo.Session, event *discordgo.GuildCreate) {
+func (c *BotConfig) guildCreate(s Session, event *discordgo.GuildCreate) {
 	if event.Guild.Unavailable {
 		return
 	}
@@ -185,44 +236,48 @@ func (c *BotConfig) guildCreate(s *discordgo.Session, event *discordgo.GuildCrea
 	}
 	for _, channel := range event.Guild.Channels {
 		if strings.Contains(channel.Name, "bot") {
-			_, _ = s.ChannelMessageSend(channel.ID, help)
+			_, _ = s.ChannelMessageSend(channel.ID, helpMessage(c.RecordSeconds))
 			fmt.Println(channel.ID)
 			return
 		}
 	}
 	for _, channel := range event.Guild.Channels {
 		if channel.ID == event.Guild.ID {
-			_, _ = s.ChannelMessageSend(channel.ID, help)
+			_, _ = s.ChannelMessageSend(channel.ID, helpMessage(c.RecordSeconds))
 			return
 		}
 	}
 }
 
 type serverBuffer struct {
-	buf             chan *discordgo.Packet
-	start           chan struct{}
-	stop            chan struct{}
+	ring            *VoiceRing
+	stop            func()
 	InitiatedByUser string
 }
 
-func (v *serverBuffer) Start() {
-	v.start <- struct{}{}
-}
 func (v *serverBuffer) Stop() {
-	v.stop <- struct{}{}
+	v.stop()
 }
 
 var serverBuffers = map[string]serverBuffer{}
-var lastUserListenedTo = map[string]string{}
 var mu sync.Mutex
 
 var rxStrict = xurls.Strict()
 
-func (c *BotConfig) GetLinkFromMessage(s *discordgo.Session, m *discordgo.Message) (string, error) {
+// GetLinksFromMessage returns the links from the message or, if there are none, from the message it replies to
+func (c *BotConfig) GetLinksFromMessage(s Session, m *discordgo.Message) ([]string, error) {
 	sourceMessage := *m
 	var results []string
 	for depth := 0; depth <= c.MaxReplyDepth; depth++ {
 		results = linksFromMessage(&sourceMessage)
+		if len(results) == 0 && sourceMessage.Type == discordgo.MessageTypeDefault && sourceMessage.MessageReference != nil {
+			// A forwarded message has a reference and the copy of the original message in the snapshots
+			snapshots, err := s.MessageSnapshots(sourceMessage.ChannelID, sourceMessage.ID)
+			capture(err)
+			for _, snapshot := range snapshots {
+				results = append(results, linksFromMessage(snapshot)...)
+			}
+		}
 		if len(results) > 0 {
 			break
 		}
@@ -232,15 +287,39 @@ func (c *BotConfig) GetLinkFromMessage(s *discordgo.Session, m *discordgo.Messag
 		if sourceMessage.MessageReference.MessageID != "" {
 			replyTo, err := s.ChannelMessage(sourceMessage.MessageReference.ChannelID, sourceMessage.MessageReference.MessageID)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
 			sourceMessage = *replyTo
 		}
 	}
 	if len(results) == 0 {
-		return "", nil
+		return c.threadStarterLinks(s, m.ChannelID), nil
+	}
+	return results, nil
+}
+
+// threadStarterLinks returns the links from the message the thread was started from, if the channel is a thread
+func (c *BotConfig) threadStarterLinks(s Session, channelID string) []string {
+	ch, err := s.StateChannel(channelID)
+	if err != nil {
+		// Threads aren't always in the state
+		if ch, err = s.Channel(channelID); capture(err) {
+			return nil
+		}
+	}
+	// Public, private, and announcement threads
+	if ch.Type < 10 || ch.Type > 12 {
+		return nil
+	}
+	// A thread started from a message has the same ID as the message in the parent channel;
+	// the first message of a forum post has the same ID as the thread
+	starter, err := s.ChannelMessage(ch.ParentID, ch.ID)
+	if err != nil {
+		if starter, err = s.ChannelMessage(ch.ID, ch.ID); err != nil {
+			return nil
+		}
 	}
-	return results[0], nil
+	return linksFromMessage(starter)
 }
 
 func GetButtons(includeDonate bool) []discordgo.MessageComponent {
@@ -258,60 +337,84 @@ func GetButtons(includeDonate bool) []discordgo.MessageComponent {
 	return []discordgo.MessageComponent{buttonsRow}
 }
 
-func (c *BotConfig) HandleQuery(s *discordgo.Session, m *discordgo.Message, canCompress bool) (bool, *discordgo.MessageSend) {
-	resultUrl, err := c.GetLinkFromMessage(s, m)
+func (c *BotConfig) HandleQuery(s Session, m *discordgo.Message, source RecognitionSource, canCompress bool) (bool, *discordgo.MessageSend) {
+	links, err := c.GetLinksFromMessage(s, m)
 	if capture(err) {
 		return false, &discordgo.MessageSend{
 			Content:   "Sorry, I got an error from Discord when I tried to get the referenced message",
 			Reference: m.Reference(),
 		}
 	}
-	if resultUrl == "" {
+	return c.HandleLinks(m, links, source, canCompress, nil)
+}
+
+// HandleLinks recognizes the music from the links found for the message. The part of the audio to recognize is r,
+// or, if r is nil, the time from the link or the message
+func (c *BotConfig) HandleLinks(m *discordgo.Message, links []string, source RecognitionSource, canCompress bool,
+	r *TimeRange) (bool, *discordgo.MessageSend) {
+	if len(links) == 0 {
 		return false, nil
 	}
-	if strings.Contains(resultUrl, "https://lis.tn/") {
+	if strings.Contains(links[0], "https://lis.tn/") {
 		fmt.Println("Skipping a reply to our comment")
 		return false, nil
 	}
-	timestampTo := 0
-	timestamp := GetSkipFirstFromLink(resultUrl)
-	if timestamp == 0 {
-		timestamp, timestampTo = GetTimeFromText(m.Content)
+	if len(links) > 1 && c.RecognizeAllLinks {
+		return true, c.recognizeLinks(m, links, source, r)
 	}
+	resultUrl := links[0]
+	parameters, at := recognitionParameters(resultUrl, requestedTimeRange(resultUrl, m.Content, r))
+	if reply := c.checkRateLimit(source.GuildID, source.ChannelID, source.UserID, m.Reference()); reply != nil {
+		return true, reply
+	}
+	fmt.Println("Recognizing from", resultUrl)
+	source.URL = resultUrl
+	result, err := c.Recognizer.RecognizeLongAudio(resultUrl, parameters)
+
+	message := c.getMessageFromRecognitionResult(result, err,
+		fmt.Sprintf("Sorry, I couldn't get any audio from %s", resultUrl),
+		fmt.Sprintf("Sorry, I couldn't recognize the song."+
+			"\n\nI tried to identify music from %s at %s.",
+			resultUrl, at), m.Reference(), &source, canCompress)
+	return true, message
+}
+
+// recognitionParameters returns the API parameters for the link and the time range, and the part of the audio they
+// make the API recognize
+func recognitionParameters(link string, r TimeRange) (map[string]string, string) {
+	timestamp, timestampTo := r.From, r.To
 	limit := 2
-	if strings.Contains(resultUrl, "https://media.discordapp.net/") {
+	if strings.Contains(link, "https://media.discordapp.net/") {
 		limit = 3
 	}
+	if r.Last > 0 {
+		limit = (r.Last + enterpriseChunkLength - 1) / enterpriseChunkLength
+		if limit > maxLastChunks {
+			limit = maxLastChunks
+		}
+	}
 	if timestampTo != 0 && timestampTo-timestamp > limit*enterpriseChunkLength {
 		// recognize music at the middle of the specified interval
 		timestamp += (timestampTo - timestamp - limit*enterpriseChunkLength) / 2
 	}
 	timestampTo = timestamp + limit*enterpriseChunkLength
-	atTheEnd := "false"
-	if timestamp == 0 && strings.Contains(m.Content, "at the end") {
-		atTheEnd = "true"
-	}
-	fmt.Println("Recognizing from", resultUrl)
-	result, err := AudDClient.RecognizeLongAudio(resultUrl,
-		map[string]string{"accurate_offsets": "true", "limit": strconv.Itoa(limit),
-			"skip_first_seconds": strconv.Itoa(timestamp), "reversed_order": atTheEnd})
-
+	atTheEnd := strconv.FormatBool(r.FromEnd)
 	at := SecondsToTimeString(timestamp, timestampTo >= 3600) + "-" + SecondsToTimeString(timestampTo, timestampTo >= 3600)
-	if atTheEnd == "true" {
+	if r.FromEnd {
 		at = "the end"
+		if r.Last > 0 {
+			at = fmt.Sprintf("the last %d seconds", limit*enterpriseChunkLength)
+		}
 	}
-
-	message := c.getMessageFromRecognitionResult(result, err,
-		fmt.Sprintf("Sorry, I couldn't get any audio from %s", resultUrl),
-		fmt.Sprintf("Sorry, I couldn't recognize the song."+
-			"\n\nI tried to identify music from %s at %s.",
-			resultUrl, at), m.Reference(), canCompress)
-	return true, message
+	return map[string]string{"accurate_offsets": "true", "limit": strconv.Itoa(limit),
+		"skip_first_seconds": strconv.Itoa(timestamp), "reversed_order": atTheEnd}, at
 }
 
 func (c *BotConfig) getMessageFromRecognitionResult(result []audd.RecognitionEnterpriseResult, err error,
-	responseNoAudio, responseNoResult string, reference *discordgo.MessageReference, canCompress bool) *discordgo.MessageSend {
+	responseNoAudio, responseNoResult string, reference *discordgo.MessageReference, source *RecognitionSource,
+	canCompress bool) *discordgo.MessageSend {
 	songs, highestScore := GetSongs(result, c.MinScore)
+	capture(History.Add(source, songs))
 	response := &discordgo.MessageSend{}
 	if reference != nil {
 		response.Reference = reference
@@ -415,8 +518,20 @@ var ApplicationCommands = []*discordgo.ApplicationCommand{
 			Type:        discordgo.ApplicationCommandOptionUser,
 			Name:        "speaker",
 			Description: "User playing the music on the voice channel",
-			Required:    true,
-		}},
+		}, {
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "mode",
+			Description: "What to recognize if no speaker is mentioned",
+			Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "Detect who is playing music", Value: SpeakerModeAuto},
+				{Name: "Mix all speakers", Value: SpeakerModeMix},
+				{Name: "The loudest speaker", Value: SpeakerModeLoudest},
+			},
+		}, {
+			Type:        discordgo.ApplicationCommandOptionInteger,
+			Name:        "duration",
+			Description: fmt.Sprintf("How many seconds of audio to record, from %d to %d", MinRecordSeconds, MaxRecordSeconds),
+		}, privateOption},
 	},
 	{
 		Type:        discordgo.ChatApplicationCommand,
@@ -426,21 +541,25 @@ var ApplicationCommands = []*discordgo.ApplicationCommand{
 	{
 		Type:        discordgo.ChatApplicationCommand,
 		Name:        "listen",
-		Description: "Join the voice channel and wait for /song-vc, then immediately identify music from last 12 seconds",
+		Description: "Join the voice channel and wait for /song-vc, then immediately identify music from the last seconds of audio",
 	},
 	{
 		Type:        discordgo.ChatApplicationCommand,
 		Name:        "disconnect",
 		Description: "Leave the voice channel",
 	},
+	historyCommand,
+	settingsCommand,
+	recognizeCommand,
+	recognizeMixCommand,
 	{
 		Type: discordgo.MessageApplicationCommand,
 		Name: "Recognize This Song",
 	},
 }
 
-var commandHandlers = map[string]func(c *BotConfig, s *discordgo.Session, i *discordgo.InteractionCreate){
-	"Recognize This Song": func(c *BotConfig, s *discordgo.Session, i *discordgo.InteractionCreate) {
+var commandHandlers = map[string]func(c *BotConfig, s Session, i *discordgo.InteractionCreate){
+	"Recognize This Song": func(c *BotConfig, s Session, i *discordgo.InteractionCreate) {
 		data := i.ApplicationCommandData()
 		if data.Resolved == nil {
 			return
@@ -455,7 +574,11 @@ var commandHandlers = map[string]func(c *BotConfig, s *discordgo.Session, i *dis
 		if m == nil {
 			return
 		}
-		reacted, message := c.HandleQuery(s, m, true)
+		reacted, message := c.HandleQuery(s, m, RecognitionSource{
+			GuildID:   i.GuildID,
+			ChannelID: i.ChannelID,
+			UserID:    interactionUserID(i),
+		}, true)
 		if !reacted {
 			capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 				Type: discordgo.InteractionResponseChannelMessageWithSource,
@@ -467,17 +590,10 @@ var commandHandlers = map[string]func(c *BotConfig, s *discordgo.Session, i *dis
 		}
 		capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseChannelMessageWithSource,
-			Data: &discordgo.InteractionResponseData{
-				Content:         message.Content,
-				Components:      message.Components,
-				Embeds:          message.Embeds,
-				Files:           message.Files,
-				TTS:             message.TTS,
-				AllowedMentions: message.AllowedMentions,
-			},
+			Data: interactionResponseData(message),
 		}))
 	},
-	"song-vc": func(c *BotConfig, s *discordgo.Session, i *discordgo.InteractionCreate) {
+	"song-vc": func(c *BotConfig, s Session, i *discordgo.InteractionCreate) {
 		data := i.ApplicationCommandData()
 		if i.Member == nil {
 			b, _ := json.Marshal(i)
@@ -493,45 +609,48 @@ var commandHandlers = map[string]func(c *BotConfig, s *discordgo.Session, i *dis
 			fmt.Println(string(b))
 			return
 		}
-		var UserToListenToID string
-		if data.Options != nil {
-			if len(data.Options) > 0 {
-				if data.Options[0].Type == discordgo.ApplicationCommandOptionUser {
-					UserToListenToID = data.Options[0].Value.(string)
-				}
+		var UserToListenToID, mode string
+		seconds := c.RecordSeconds
+		for _, option := range data.Options {
+			switch option.Name {
+			case "speaker":
+				UserToListenToID = option.Value.(string)
+			case "mode":
+				mode = option.StringValue()
+			case "duration":
+				seconds = int(option.IntValue())
 			}
 		}
-		capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-			Type: discordgo.InteractionResponseChannelMessageWithSource,
-			Data: &discordgo.InteractionResponseData{
-				Content: "Collecting 12 seconds of audio...",
-			},
-		}))
-		_, message := c.SongVCCommand(s, i.Member.User.ID, UserToListenToID, i.GuildID, nil, true)
+		if seconds < MinRecordSeconds || seconds > MaxRecordSeconds {
+			capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: fmt.Sprintf("The duration should be from %d to %d seconds", MinRecordSeconds, MaxRecordSeconds),
+					Flags:   1 << 6,
+				},
+			}))
+			return
+		}
+		// The deferred response is only edited with the result, so it still says it's taking too long on a timeout
+		_, message := c.SongVCCommand(s, i.Member.User.ID, UserToListenToID, mode, i.GuildID, i.ChannelID, seconds, nil, true)
 		if message == nil {
 			message = &discordgo.MessageSend{
 				Content: "Sorry, I experienced an unexpected error",
 			}
 		}
-		_, err := s.FollowupMessageCreate(c.DiscordAppID, i.Interaction, true, &discordgo.WebhookParams{
-			Content:         message.Content,
-			Components:      message.Components,
-			Embeds:          message.Embeds,
-			Files:           message.Files,
-			TTS:             message.TTS,
-			AllowedMentions: message.AllowedMentions,
-			// Flags:           1 << 6,
-		})
-		capture(err)
+		capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: interactionResponseData(message),
+		}))
 	},
-	"help": func(c *BotConfig, s *discordgo.Session, i *discordgo.InteractionCreate) {
+	"help": func(c *BotConfig, s Session, i *discordgo.InteractionCreate) {
 		if i.Member == nil {
 			return
 		}
 		if i.Member.User == nil {
 			return
 		}
-		message := help
+		message := helpMessage(c.RecordSeconds)
 		capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseChannelMessageWithSource,
 			Data: &discordgo.InteractionResponseData{
@@ -539,7 +658,7 @@ var commandHandlers = map[string]func(c *BotConfig, s *discordgo.Session, i *dis
 			},
 		}))
 	},
-	"listen": func(c *BotConfig, s *discordgo.Session, i *discordgo.InteractionCreate) {
+	"listen": func(c *BotConfig, s Session, i *discordgo.InteractionCreate) {
 		if i.Member == nil {
 			return
 		}
@@ -557,7 +676,7 @@ var commandHandlers = map[string]func(c *BotConfig, s *discordgo.Session, i *dis
 			},
 		}))
 	},
-	"disconnect": func(c *BotConfig, s *discordgo.Session, i *discordgo.InteractionCreate) {
+	"disconnect": func(c *BotConfig, s Session, i *discordgo.InteractionCreate) {
 		if i.Member == nil {
 			return
 		}
@@ -582,20 +701,53 @@ var commandHandlers = map[string]func(c *BotConfig, s *discordgo.Session, i *dis
 			}))
 		}
 	},
+	"history":       (*BotConfig).HistoryCommand,
+	"settings":      (*BotConfig).SettingsCommand,
+	"recognize":     (*BotConfig).RecognizeCommand,
+	"recognize-mix": (*BotConfig).RecognizeMixCommand,
 }
 
-func (c *BotConfig) interactionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+// componentHandlers are keyed by the part of the custom ID before the first colon
+var componentHandlers = map[string]func(c *BotConfig, s Session, i *discordgo.InteractionCreate){
+	"history": (*BotConfig).HistoryButton,
+}
+
+func interactionUserID(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
+
+func (c *BotConfig) interactionCreate(s Session, i *discordgo.InteractionCreate) {
+	c = c.ForGuild(i.GuildID)
+	if i.Type == discordgo.InteractionMessageComponent {
+		customID := i.MessageComponentData().CustomID
+		if h, ok := componentHandlers[strings.Split(customID, ":")[0]]; ok {
+			h(c, s, i)
+		} else {
+			fmt.Println("Unknown component:", customID)
+		}
+		return
+	}
+	if i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
 	if h, ok := commandHandlers[i.ApplicationCommandData().Name]; ok {
-		h(c, s, i)
+		c.handleCommand(s, i, h)
 	} else {
 		fmt.Println("Unknown command:", i.ApplicationCommandData().Name)
 	}
 }
 
-func (c *BotConfig) messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
-	if m.Author.ID == s.State.User.ID {
+func (c *BotConfig) messageCreate(s Session, m *discordgo.MessageCreate) {
+	if m.Author.ID == s.BotUserID() {
 		return
 	}
+	c = c.ForGuild(m.GuildID)
 	if strings.HasPrefix(m.Content, "!here") {
 		fmt.Println(m.ChannelID, m.GuildID)
 		_, _ = s.ChannelMessageSendReply(m.ChannelID, "Guild ID: "+m.GuildID+", Channel ID: "+m.ChannelID, m.Reference())
@@ -613,35 +765,63 @@ func (c *BotConfig) messageCreate(s *discordgo.Session, m *discordgo.MessageCrea
 		return
 	}
 	if m.Content == "!help" {
-		_, _ = s.ChannelMessageSendReply(m.ChannelID, help, m.Reference())
+		_, _ = s.ChannelMessageSendReply(m.ChannelID, helpMessage(c.RecordSeconds), m.Reference())
 		return
 	}
-	compare := getBodyToCompare(m.Content)
-	triggered, trigger := substringInSlice(compare, c.Triggers)
-	if triggered {
-		reactedToUrl, message := c.HandleQuery(s, m.Message, c.CanCompressWithoutSlash) // Try to find a video or an audio and react to it
+	locale := ""
+	if g, err := s.StateGuild(m.GuildID); err == nil {
+		locale = g.PreferredLocale
+	}
+	decision := c.evaluateTrigger(m.Message, locale)
+	if decision.Trigger.Pattern != "" {
+		fmt.Printf("Message %s in %s: responding: %t, %s\n", m.ID, m.ChannelID, decision.Respond, decision.Reason)
+		if !decision.Respond {
+			return
+		}
+		source := RecognitionSource{
+			GuildID:   m.GuildID,
+			ChannelID: m.ChannelID,
+			UserID:    m.Author.ID,
+		}
+		if mixRequested(m.Content, decision.Trigger, locale) && c.MixFromMessage(s, m.Message, source) {
+			return
+		}
+		reactedToUrl, message := c.HandleQuery(s, m.Message, source, c.CanCompressWithoutSlash) // Try to find a video or an audio and react to it
 		if reactedToUrl {
 			if message != nil {
-				c.sendResult(m.ChannelID, message, false)
+				c.sendMessage(s, m.ChannelID, message, false)
 			}
 			return
 		}
+		// Without a reply, a link, or a mention, the user probably asks about a clip posted just before,
+		// unless they're on a voice channel
+		if m.MessageReference == nil && len(m.Mentions) == 0 && !decision.Quiet && !inVoiceChannel(s, m.GuildID, m.Author.ID) {
+			if recent, links := c.findRecentMedia(s, m.Message); recent != nil {
+				reactedToUrl, message = c.HandleLinks(m.Message, links, source, c.CanCompressWithoutSlash, nil)
+				if message != nil {
+					message.Content = strings.TrimSpace(recentMediaConfirmation(m.GuildID, recent) + "\n\n" + message.Content)
+					c.sendMessage(s, m.ChannelID, message, false)
+				}
+				if reactedToUrl {
+					return
+				}
+			}
+		}
 		var UserToListenToID string
 		if len(m.Mentions) > 0 {
 			UserToListenToID = m.Mentions[0].ID
 		}
-		channel, err := s.State.Channel(m.ChannelID)
+		channel, err := s.StateChannel(m.ChannelID)
 		if capture(err) {
 			return
 		}
-		replyInAnyCase, message := c.SongVCCommand(s, m.Author.ID, UserToListenToID, channel.GuildID, m.Reference(), c.CanCompressWithoutSlash)
-		if !replyInAnyCase {
-			if strings.Count(compare, " ") > strings.Count(trigger, " ")+2 {
-				return
-			}
+		replyInAnyCase, message := c.SongVCCommand(s, m.Author.ID, UserToListenToID, "", channel.GuildID, m.ChannelID, c.RecordSeconds, m.Reference(),
+			c.CanCompressWithoutSlash)
+		if !replyInAnyCase && decision.Quiet {
+			return
 		}
 		if message != nil {
-			c.sendResult(m.ChannelID, message, false)
+			c.sendMessage(s, m.ChannelID, message, false)
 		}
 		return
 	}
@@ -658,9 +838,10 @@ func (c *BotConfig) messageCreate(s *discordgo.Session, m *discordgo.MessageCrea
 	}
 }
 
-func (c *BotConfig) SongVCCommand(s *discordgo.Session,
-	userID, userToListenToID, guildID string, reference *discordgo.MessageReference, canCompress bool) (bool, *discordgo.MessageSend) {
-	g, err := s.State.Guild(guildID)
+func (c *BotConfig) SongVCCommand(s Session,
+	userID, userToListenToID, mode, guildID, channelID string, seconds int, reference *discordgo.MessageReference,
+	canCompress bool) (bool, *discordgo.MessageSend) {
+	g, err := s.StateGuild(guildID)
 	if capture(err) {
 		return false, nil
 	}
@@ -668,24 +849,12 @@ func (c *BotConfig) SongVCCommand(s *discordgo.Session,
 		if vs.UserID != userID {
 			continue
 		}
-		if userToListenToID == "" {
-			mu.Lock()
-			userToListenToID = lastUserListenedTo[g.ID+"-"+vs.ChannelID]
-			mu.Unlock()
-		}
-		if userToListenToID == "" {
-			reply := &discordgo.MessageSend{
-				Content: "Please mention the user playing the music in a voice channel (like !song @musicbot) or " +
-					"reply with !song to a message with an audio file or a link to the audio file and I'll identify the music",
-			}
-			if reference != nil {
-				reply.Reference = reference
-			}
+		if reply := c.checkRateLimit(g.ID, channelID, userID, reference); reply != nil {
 			return true, reply
 		}
+		// If nobody is mentioned, detecting who is playing music
 		mu.Lock()
 		existedBuf, alreadySet := serverBuffers[g.ID+"-"+vs.ChannelID]
-		lastUserListenedTo[g.ID+"-"+vs.ChannelID] = userToListenToID
 		mu.Unlock()
 		var audioBuf []byte
 
@@ -695,7 +864,7 @@ func (c *BotConfig) SongVCCommand(s *discordgo.Session,
 		if alreadySet {
 			/*_, _ = s.ChannelMessageSendReply(m.ChannelID, "I'll identify the song in the 12 seconds of audio",
 			m.Reference())*/
-			audioBuf, err = c.getBufferBytes(existedBuf, userToListenToID)
+			audioBuf, err = getWavAudio(existedBuf.ring, userToListenToID, mode, seconds)
 		} else {
 			/*_, _ = s.ChannelMessageSendReply(m.ChannelID, "I'm listening to the audio for 12 seconds and "+
 			"will identify the song after that",
@@ -720,7 +889,7 @@ func (c *BotConfig) SongVCCommand(s *discordgo.Session,
 				delete(serverBuffers, g.ID+"-"+vs.ChannelID)
 				mu.Unlock()
 			*/
-			audioBuf, err = c.recordSound(s, g.ID, vs.ChannelID, userToListenToID)
+			audioBuf, err = c.recordSound(s, g.ID, vs.ChannelID, userToListenToID, mode, seconds)
 			mu.Lock()
 			delete(serverBuffers, g.ID+"-"+vs.ChannelID)
 			mu.Unlock()
@@ -735,11 +904,16 @@ func (c *BotConfig) SongVCCommand(s *discordgo.Session,
 			return true, reply
 		}
 		fmt.Println("Recognizing from a buffer")
-		result, err := AudDClient.RecognizeLongAudio(audioBuf,
+		result, err := c.Recognizer.RecognizeLongAudio(audioBuf,
 			map[string]string{"accurate_offsets": "true", "limit": "1"})
 		message := c.getMessageFromRecognitionResult(result, err,
 			"Sorry, I couldn't record the audio",
-			"Sorry, I couldn't recognize the song.", reference, canCompress)
+			"Sorry, I couldn't recognize the song.", reference, &RecognitionSource{
+				GuildID:        g.ID,
+				ChannelID:      channelID,
+				UserID:         userID,
+				VoiceChannelID: vs.ChannelID,
+			}, canCompress)
 		if reference != nil {
 			go s.MessageReactionRemove(reference.ChannelID, reference.MessageID, "🎧", "@me")
 		}
@@ -756,7 +930,6 @@ func (c *BotConfig) SongVCCommand(s *discordgo.Session,
 }
 
 //ToDo: leave the VC if it's empty/the person who added it has left
-//ToDo: a setting allowing to change from 12 to other numbers of  seconds
 
 type GuildChPair struct {
 	GuildID   string
@@ -765,7 +938,7 @@ type GuildChPair struct {
 
 var UsersInvitedBot = map[string]GuildChPair{}
 
-func (c *BotConfig) ListenCommand(s *discordgo.Session, guildID, userID string) string {
+func (c *BotConfig) ListenCommand(s Session, guildID, userID string) string {
 	if c.BotInvitedToVC(s, guildID, userID) {
 		return "Listening!\n" +
 			"Type !song with a mention to recognize a song played by someone mentioned."
@@ -773,8 +946,8 @@ func (c *BotConfig) ListenCommand(s *discordgo.Session, guildID, userID string)
 	return ""
 }
 
-func (c *BotConfig) BotInvitedToVC(s *discordgo.Session, guildID, userID string) bool {
-	g, err := s.State.Guild(guildID)
+func (c *BotConfig) BotInvitedToVC(s Session, guildID, userID string) bool {
+	g, err := s.StateGuild(guildID)
 	if capture(err) {
 		return false
 	}
@@ -789,7 +962,8 @@ func (c *BotConfig) BotInvitedToVC(s *discordgo.Session, guildID, userID string)
 		if vs.UserID != userID {
 			continue
 		}
-		err := CreateAndStartBuffer(s, g.ID, vs.ChannelID, userID)
+		// The buffer keeps the longest recording, so /song-vc can read any duration from it
+		err := CreateAndStartBuffer(s, g.ID, vs.ChannelID, userID, MaxRecordSeconds)
 		if capture(err) {
 			return false
 		}
@@ -802,7 +976,7 @@ func (c *BotConfig) BotInvitedToVC(s *discordgo.Session, guildID, userID string)
 
 }
 
-func (c *BotConfig) StopListeningCommand(s *discordgo.Session, guildID, userID string) (left bool, response string) {
+func (c *BotConfig) StopListeningCommand(s Session, guildID, userID string) (left bool, response string) {
 	leavingResponse := "Bye!"
 	mu.Lock()
 	ch, exists := UsersInvitedBot[userID]
@@ -814,7 +988,7 @@ func (c *BotConfig) StopListeningCommand(s *discordgo.Session, guildID, userID s
 		response = leavingResponse
 		left = true
 	}
-	g, err := s.State.Guild(guildID)
+	g, err := s.StateGuild(guildID)
 	if capture(err) {
 		return
 	}
@@ -854,15 +1028,6 @@ func (c *BotConfig) StopListeningCommand(s *discordgo.Session, guildID, userID s
 	return
 }
 
-func (c *BotConfig) getBufferBytes(buffer serverBuffer, userToListenToID string) ([]byte, error) {
-	buffer.Start()
-	audioBuf, err := getWavAudio(buffer.buf, true, userToListenToID)
-	if err != nil {
-		return nil, err
-	}
-	return audioBuf, nil
-}
-
 func loadConfig(file string) (*BotConfig, error) {
 	var cfg BotConfig
 	f, err := os.Open(file)
@@ -877,11 +1042,35 @@ func loadConfig(file string) (*BotConfig, error) {
 	if err != nil {
 		return nil, err
 	}
-	if stringInSlice(cfg.Triggers, "") {
-		return nil, fmt.Errorf("got a config with an empty string in the triggers")
+	if cfg.DatabaseFile == "" {
+		cfg.DatabaseFile = "discordBot.db"
+	}
+	if cfg.MaxLinksPerMessage == 0 {
+		cfg.MaxLinksPerMessage = 5
+	}
+	if cfg.MaxLinksPerMessage < 0 || cfg.MaxLinksPerMessage > maxLinksPerMessageLimit {
+		return nil, fmt.Errorf("got a config with MaxLinksPerMessage outside of the 1-%d range", maxLinksPerMessageLimit)
 	}
-	if stringInSlice(cfg.AntiTriggers, "") {
-		return nil, fmt.Errorf("got a config with an empty string in the anti-triggers")
+	if cfg.ScanRecentMessages == 0 {
+		cfg.ScanRecentMessages = 20
+	}
+	if cfg.ScanRecentMessages > 100 {
+		return nil, fmt.Errorf("got a config with ScanRecentMessages over 100")
+	}
+	if cfg.MaxMixMinutes == 0 {
+		cfg.MaxMixMinutes = 60
+	}
+	if cfg.MaxParallelRecognitions <= 0 {
+		cfg.MaxParallelRecognitions = 3
+	}
+	if cfg.CacheTTLMinutes == 0 {
+		cfg.CacheTTLMinutes = 1440
+	}
+	if cfg.RecordSeconds == 0 {
+		cfg.RecordSeconds = 12
+	}
+	if cfg.RecordSeconds < MinRecordSeconds || cfg.RecordSeconds > MaxRecordSeconds {
+		return nil, fmt.Errorf("got a config with RecordSeconds outside of the %d-%d range", MinRecordSeconds, MaxRecordSeconds)
 	}
 	return &cfg, nil
 }
@@ -901,7 +1090,7 @@ func (c *BotConfig) ready(s *discordgo.Session, _ *discordgo.Ready) {
 		if i, stillWant := names[oldCmd.Name]; stillWant {
 			delete(names, oldCmd.Name)
 			wantedCmd := ApplicationCommands[i]
-			if oldCmd.Description != wantedCmd.Description { // ToDo: full comparison instead of just descriptions?
+			if commandChanged(oldCmd, wantedCmd) {
 				updatedCmd, err := s.ApplicationCommandEdit(c.DiscordAppID, "", oldCmd.ID, wantedCmd)
 				capture(err)
 				b, _ := json.Marshal(updatedCmd)
@@ -921,6 +1110,15 @@ func (c *BotConfig) ready(s *discordgo.Session, _ *discordgo.Ready) {
 	}
 }
 
+func commandChanged(oldCmd, wantedCmd *discordgo.ApplicationCommand) bool {
+	if oldCmd.Description != wantedCmd.Description {
+		return true
+	}
+	oldOptions, _ := json.Marshal(oldCmd.Options)
+	wantedOptions, _ := json.Marshal(wantedCmd.Options)
+	return string(oldOptions) != string(wantedOptions)
+}
+
 func (c *BotConfig) resumed(s *discordgo.Session, _ *discordgo.Resumed) {
 	dSessionMu.Lock()
 	dSession = s
@@ -982,19 +1180,7 @@ func (c *BotConfig) getResult(results []audd.RecognitionResult, includePlaysOn,
 	if compressToText {
 		texts := make([]string, 0)
 		for _, song := range results {
-			addTimecodeToLink(&song)
-			score := strconv.Itoa(song.Score) + "%"
-			text := fmt.Sprintf("[**%s** by %s](%s)",
-				song.Title, song.Artist, song.SongLink)
-			if includeScore {
-				text += fmt.Sprintf(" (%s; matched: `%s`)", song.Timecode, score)
-			}
-			releaseInfo := getReleaseInfoString(&song)
-			if releaseInfo != "" {
-				text += fmt.Sprintf("\n%s.",
-					releaseInfo)
-			}
-			texts = append(texts, text)
+			texts = append(texts, songText(song, includeScore))
 		}
 		if len(texts) == 1 {
 			baseMessage.Content += texts[0]
@@ -1114,6 +1300,23 @@ func (c *BotConfig) getResult(results []audd.RecognitionResult, includePlaysOn,
 	return baseMessage
 }
 
+// songText is the song as a single line of text, followed by the release info
+func songText(song audd.RecognitionResult, includeScore bool) string {
+	addTimecodeToLink(&song)
+	score := strconv.Itoa(song.Score) + "%"
+	text := fmt.Sprintf("[**%s** by %s](%s)",
+		song.Title, song.Artist, song.SongLink)
+	if includeScore {
+		text += fmt.Sprintf(" (%s; matched: `%s`)", song.Timecode, score)
+	}
+	releaseInfo := getReleaseInfoString(&song)
+	if releaseInfo != "" {
+		text += fmt.Sprintf("\n%s.",
+			releaseInfo)
+	}
+	return text
+}
+
 func (c *BotConfig) sendResult(channelID string, message *discordgo.MessageSend, publishAnnouncement bool) {
 	dSessionMu.Lock()
 	s := dSession
@@ -1135,6 +1338,10 @@ func (c *BotConfig) sendResult(channelID string, message *discordgo.MessageSend,
 	if s == nil {
 		return
 	}
+	c.sendMessage(discordSession{s}, channelID, message, publishAnnouncement)
+}
+
+func (c *BotConfig) sendMessage(s Session, channelID string, message *discordgo.MessageSend, publishAnnouncement bool) {
 	m, err := s.ChannelMessageSendComplex(channelID, message)
 	if capture(err) {
 		b, _ := json.Marshal(message)
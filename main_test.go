@@ -0,0 +1,446 @@
+package main
+
+import (
+	"github.com/AudDMusic/audd-go"
+	"github.com/Mihonarium/discordgo"
+	"github.com/getsentry/sentry-go"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// capture sends the errors to the current Sentry client, so there has to be one
+	if err := sentry.Init(sentry.ClientOptions{}); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+const (
+	testGuildID   = "guild"
+	testChannelID = "channel"
+	testUserID    = "user"
+	testBotID     = "bot"
+)
+
+var testSongs = []audd.RecognitionResult{
+	{Artist: "Imagine Dragons", Title: "Warriors", Album: "Warriors", ReleaseDate: "2014-09-18",
+		Timecode: "00:40", SongLink: "https://lis.tn/Warriors", Score: 100},
+	{Artist: "Daft Punk", Title: "One More Time", Album: "Discovery", ReleaseDate: "2000-11-13",
+		Timecode: "01:02", SongLink: "https://lis.tn/OneMoreTime", Score: 90},
+}
+
+// newTestBot returns the config with a fake recognizer and a session with a server and a text channel
+func newTestBot() (*BotConfig, *FakeSession, *FakeRecognizer) {
+	recognizer := &FakeRecognizer{Fixtures: []RecognitionFixture{
+		{Match: "no-audio", Error: &audd.Error{ErrorCode: 501, ErrorMessage: "can't get any audio"}},
+		{Match: "unknown-song", Result: []audd.RecognitionEnterpriseResult{}},
+		{Match: "two-songs", Result: []audd.RecognitionEnterpriseResult{{Offset: "00:00", Songs: testSongs}}},
+		{Result: []audd.RecognitionEnterpriseResult{{Offset: "00:00", Songs: testSongs[:1]}}},
+	}}
+	c := &BotConfig{
+		Triggers:             []TriggerRule{{Pattern: "!song"}, {Pattern: "whats the song"}},
+		AntiTriggers:         []TriggerRule{{Pattern: "whats the song about"}},
+		MaxTriggerTextLength: 300,
+		MaxReplyDepth:        2,
+		MinScore:             65,
+		UncompressedLimit:    2,
+		RecordSeconds:        12,
+		MaxLinksPerMessage:   5,
+		MaxMixMinutes:        60,
+		Recognizer:           recognizer,
+	}
+	s := NewFakeSession(testBotID)
+	s.Guilds[testGuildID] = &discordgo.Guild{ID: testGuildID}
+	s.Channels[testChannelID] = &discordgo.Channel{ID: testChannelID, GuildID: testGuildID}
+	return c, s, recognizer
+}
+
+func testMessage(id, content string) *discordgo.Message {
+	return &discordgo.Message{
+		ID:        id,
+		ChannelID: testChannelID,
+		GuildID:   testGuildID,
+		Content:   content,
+		Author:    &discordgo.User{ID: testUserID},
+		Timestamp: time.Now(),
+	}
+}
+
+func reply(m *discordgo.Message, to string) *discordgo.Message {
+	m.Type = discordgo.MessageTypeReply
+	m.MessageReference = &discordgo.MessageReference{MessageID: to, ChannelID: testChannelID, GuildID: testGuildID}
+	return m
+}
+
+// posted makes the message older and sets the name of its author
+func posted(m *discordgo.Message, username string, ago time.Duration) *discordgo.Message {
+	m.Author = &discordgo.User{ID: username, Username: username}
+	m.Timestamp = time.Now().Add(-ago)
+	return m
+}
+
+// sentText joins the content and the embed titles and descriptions of a message, so the tests can look for the songs
+func sentText(m *discordgo.MessageSend) string {
+	parts := []string{m.Content}
+	for _, e := range m.Embeds {
+		parts = append(parts, e.Title, e.Description)
+	}
+	return strings.Join(parts, "\n")
+}
+
+func TestMessageCreate(t *testing.T) {
+	tests := []struct {
+		name string
+		// history is added to the channel before the message
+		history   []*discordgo.Message
+		message   *discordgo.Message
+		configure func(c *BotConfig)
+		locale    string
+		// contains is what the reply has to contain; without it, there must be no reply
+		contains    []string
+		notContains []string
+		check       func(t *testing.T, m *discordgo.MessageSend)
+	}{
+		{
+			name:     "trigger with a link",
+			message:  testMessage("1", "!song https://example.com/clip.mp4"),
+			contains: []string{"Warriors"},
+		},
+		{
+			name:     "trigger after an apostrophe",
+			message:  testMessage("1", "what's the song? https://example.com/clip.mp4"),
+			contains: []string{"Warriors"},
+		},
+		{
+			name:    "no trigger",
+			message: testMessage("1", "check this out https://example.com/clip.mp4"),
+		},
+		{
+			name:    "anti-trigger",
+			message: testMessage("1", "what's the song about? https://example.com/clip.mp4"),
+		},
+		{
+			name: "trigger in the middle of a long message",
+			message: testMessage("1", strings.Repeat("a long story ", 30)+"!song "+
+				strings.Repeat("and more ", 10)),
+		},
+		{
+			name:    "trigger at the start of a long message",
+			message: testMessage("1", "whats the song "+strings.Repeat("in my head all day ", 20)),
+		},
+		{
+			name:     "trigger and a link at the start of a long message",
+			message:  testMessage("1", "!song https://example.com/clip.mp4 "+strings.Repeat("a long story ", 30)),
+			contains: []string{"Warriors"},
+		},
+		{
+			name:      "whole-word trigger",
+			message:   testMessage("1", "!song https://example.com/clip.mp4"),
+			configure: func(c *BotConfig) { c.Triggers = []TriggerRule{{Pattern: "!song", WordBoundary: true}} },
+			contains:  []string{"Warriors"},
+		},
+		{
+			name:      "whole-word trigger in a longer word",
+			message:   testMessage("1", "!songs https://example.com/clip.mp4"),
+			configure: func(c *BotConfig) { c.Triggers = []TriggerRule{{Pattern: "!song", WordBoundary: true}} },
+		},
+		{
+			name:    "regex trigger",
+			message: testMessage("1", "Which song is that? https://example.com/clip.mp4"),
+			configure: func(c *BotConfig) {
+				c.Triggers = []TriggerRule{{Pattern: `(what|which) song is (this|that)`, Regex: true}}
+			},
+			contains: []string{"Warriors"},
+		},
+		{
+			name:      "trigger in the language of the server",
+			message:   testMessage("1", "qual é a música https://example.com/clip.mp4"),
+			configure: func(c *BotConfig) { c.Triggers = []TriggerRule{{Pattern: "qual é a música", Language: "pt"}} },
+			locale:    "pt-BR",
+			contains:  []string{"Warriors"},
+		},
+		{
+			name:      "trigger in another language",
+			message:   testMessage("1", "qual é a música https://example.com/clip.mp4"),
+			configure: func(c *BotConfig) { c.Triggers = []TriggerRule{{Pattern: "qual é a música", Language: "pt"}} },
+			locale:    "en-US",
+		},
+		{
+			name:      "recent media",
+			history:   []*discordgo.Message{posted(testMessage("1", "https://example.com/clip.mp4"), "alice", time.Minute)},
+			message:   testMessage("2", "!song"),
+			configure: func(c *BotConfig) { c.ScanRecentMessages = 20 },
+			contains: []string{"Recognizing [the clip](https://discord.com/channels/guild/channel/1) posted by **alice**",
+				"Warriors"},
+		},
+		{
+			name: "recent media is too old",
+			history: []*discordgo.Message{
+				posted(testMessage("1", "https://example.com/clip.mp4"), "alice", 2*time.Hour),
+			},
+			message:     testMessage("2", "!song"),
+			configure:   func(c *BotConfig) { c.ScanRecentMessages = 20 },
+			contains:    []string{"You need to be in a voice channel"},
+			notContains: []string{"Warriors"},
+		},
+		{
+			name:     "reply to a link",
+			history:  []*discordgo.Message{testMessage("1", "https://example.com/clip.mp4")},
+			message:  reply(testMessage("2", "!song"), "1"),
+			contains: []string{"Warriors"},
+		},
+		{
+			name: "reply to a reply within the reply depth",
+			history: []*discordgo.Message{
+				testMessage("1", "https://example.com/clip.mp4"),
+				reply(testMessage("2", "nice"), "1"),
+			},
+			message:  reply(testMessage("3", "!song"), "2"),
+			contains: []string{"Warriors"},
+		},
+		{
+			name: "reply to a reply deeper than the reply depth",
+			history: []*discordgo.Message{
+				testMessage("1", "https://example.com/clip.mp4"),
+				reply(testMessage("2", "nice"), "1"),
+			},
+			message:     reply(testMessage("3", "!song"), "2"),
+			configure:   func(c *BotConfig) { c.MaxReplyDepth = 1 },
+			contains:    []string{"You need to be in a voice channel"},
+			notContains: []string{"Warriors"},
+		},
+		{
+			name:     "no audio",
+			message:  testMessage("1", "!song https://example.com/no-audio.mp4"),
+			contains: []string{"Sorry, I couldn't get any audio from https://example.com/no-audio.mp4"},
+		},
+		{
+			name:     "no result",
+			message:  testMessage("1", "!song https://example.com/unknown-song.mp4 at 1:30"),
+			contains: []string{"Sorry, I couldn't recognize the song.", "at 01:30-01:54"},
+		},
+		{
+			name:     "nothing to recognize",
+			message:  testMessage("1", "!song"),
+			contains: []string{"You need to be in a voice channel"},
+		},
+		{
+			name:    "compressed to text",
+			message: testMessage("1", "!song https://example.com/two-songs.mp4"),
+			configure: func(c *BotConfig) {
+				c.UncompressedLimit, c.CanCompressWithoutSlash = 1, true
+			},
+			contains: []string{"I got matches with these songs:", "• [**Warriors** by Imagine Dragons]",
+				"• [**One More Time** by Daft Punk]"},
+			check: func(t *testing.T, m *discordgo.MessageSend) {
+				// Only the footer is left as an embed
+				if len(m.Embeds) != 1 {
+					t.Errorf("got %d embeds, want 1", len(m.Embeds))
+				}
+			},
+		},
+		{
+			name:      "compressed to small embeds",
+			message:   testMessage("1", "!song https://example.com/two-songs.mp4"),
+			configure: func(c *BotConfig) { c.UncompressedLimit = 1 },
+			contains:  []string{"Warriors", "One More Time"},
+			check: func(t *testing.T, m *discordgo.MessageSend) {
+				if len(m.Embeds) != 3 {
+					t.Fatalf("got %d embeds, want 2 songs and the footer", len(m.Embeds))
+				}
+				for _, e := range m.Embeds[:2] {
+					if e.Thumbnail == nil || e.Image != nil {
+						t.Errorf("%s isn't compressed to a thumbnail", e.Title)
+					}
+				}
+			},
+		},
+		{
+			name:     "not compressed",
+			message:  testMessage("1", "!song https://example.com/two-songs.mp4"),
+			contains: []string{"Warriors", "One More Time"},
+			check: func(t *testing.T, m *discordgo.MessageSend) {
+				if len(m.Embeds) != 3 || m.Embeds[0].Image == nil {
+					t.Errorf("the songs aren't shown as large embeds")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, _ := newTestBot()
+			if tt.configure != nil {
+				tt.configure(c)
+			}
+			s.Guilds[testGuildID].PreferredLocale = tt.locale
+			for _, m := range tt.history {
+				s.AddMessage(m)
+			}
+			s.AddMessage(tt.message)
+			c.messageCreate(s, &discordgo.MessageCreate{Message: tt.message})
+			if len(tt.contains) == 0 {
+				if len(s.Sent) != 0 {
+					t.Fatalf("expected no reply, got %q", sentText(s.Sent[0].Message))
+				}
+				return
+			}
+			if len(s.Sent) != 1 {
+				t.Fatalf("got %d replies, want 1", len(s.Sent))
+			}
+			text := sentText(s.Sent[0].Message)
+			for _, want := range tt.contains {
+				if !strings.Contains(text, want) {
+					t.Errorf("the reply %q doesn't contain %q", text, want)
+				}
+			}
+			for _, unwanted := range tt.notContains {
+				if strings.Contains(text, unwanted) {
+					t.Errorf("the reply %q contains %q", text, unwanted)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, s.Sent[0].Message)
+			}
+		})
+	}
+}
+
+func TestMessageCreateIgnoresOwnMessages(t *testing.T) {
+	c, s, recognizer := newTestBot()
+	m := testMessage("1", "!song https://example.com/clip.mp4")
+	m.Author.ID = testBotID
+	c.messageCreate(s, &discordgo.MessageCreate{Message: m})
+	if len(s.Sent) != 0 || len(recognizer.Requests) != 0 {
+		t.Errorf("the bot reacted to its own message")
+	}
+}
+
+func testInteraction(data discordgo.ApplicationCommandInteractionData) *discordgo.InteractionCreate {
+	return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		ID:        "interaction",
+		Type:      discordgo.InteractionApplicationCommand,
+		Data:      data,
+		GuildID:   testGuildID,
+		ChannelID: testChannelID,
+		Member:    &discordgo.Member{User: &discordgo.User{ID: testUserID}},
+	}}
+}
+
+func TestInteractionCreate(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          discordgo.ApplicationCommandInteractionData
+		wantEphemeral bool
+		contains      string
+	}{
+		{
+			name: "Recognize This Song",
+			data: discordgo.ApplicationCommandInteractionData{
+				Name: "Recognize This Song",
+				Resolved: &discordgo.ApplicationCommandInteractionDataResolved{Messages: map[string]*discordgo.Message{
+					"1": testMessage("1", "https://example.com/clip.mp4"),
+				}},
+			},
+			contains: "Warriors",
+		},
+		{
+			name: "Recognize This Song without media",
+			data: discordgo.ApplicationCommandInteractionData{
+				Name: "Recognize This Song",
+				Resolved: &discordgo.ApplicationCommandInteractionDataResolved{Messages: map[string]*discordgo.Message{
+					"1": testMessage("1", "hello"),
+				}},
+			},
+			contains: "Sorry, I couldn't get any audio from this message",
+		},
+		{
+			name: "/recognize with an error",
+			data: discordgo.ApplicationCommandInteractionData{
+				Name: "recognize",
+				Options: []*discordgo.ApplicationCommandInteractionDataOption{{
+					Name: "url", Type: discordgo.ApplicationCommandOptionString, Value: "https://example.com/no-audio.mp4",
+				}},
+			},
+			contains: "Sorry, I couldn't get any audio from https://example.com/no-audio.mp4",
+		},
+		{
+			name: "private /recognize",
+			data: discordgo.ApplicationCommandInteractionData{
+				Name: "recognize",
+				Options: []*discordgo.ApplicationCommandInteractionDataOption{
+					{Name: "url", Type: discordgo.ApplicationCommandOptionString, Value: "https://example.com/clip.mp4"},
+					{Name: "private", Type: discordgo.ApplicationCommandOptionBoolean, Value: true},
+				},
+			},
+			wantEphemeral: true,
+			contains:      "Warriors",
+		},
+		{
+			name:     "/song-vc outside a voice channel",
+			data:     discordgo.ApplicationCommandInteractionData{Name: "song-vc"},
+			contains: "You need to be in a voice channel",
+		},
+		{
+			name: "/settings without the permission",
+			data: discordgo.ApplicationCommandInteractionData{
+				Name:    "settings",
+				Options: []*discordgo.ApplicationCommandInteractionDataOption{{Name: "view"}},
+			},
+			wantEphemeral: true,
+			contains:      "only members with the Manage Server permission",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, _ := newTestBot()
+			c.interactionCreate(s, testInteraction(tt.data))
+			if len(s.InteractionResponses) != 1 {
+				t.Fatalf("got %d interaction responses, want 1", len(s.InteractionResponses))
+			}
+			deferred := s.InteractionResponses[0].Response
+			if deferred.Type != discordgo.InteractionResponseDeferredChannelMessageWithSource {
+				t.Errorf("the response isn't deferred")
+			}
+			if ephemeral := deferred.Data.Flags&ephemeralFlag != 0; ephemeral != tt.wantEphemeral {
+				t.Errorf("the response is ephemeral: %t, want %t", ephemeral, tt.wantEphemeral)
+			}
+			if len(s.InteractionEdits) != 1 {
+				t.Fatalf("got %d response edits, want 1", len(s.InteractionEdits))
+			}
+			edit := s.InteractionEdits[0].Edit
+			text := sentText(&discordgo.MessageSend{Content: edit.Content, Embeds: edit.Embeds})
+			if !strings.Contains(text, tt.contains) {
+				t.Errorf("the response %q doesn't contain %q", text, tt.contains)
+			}
+		})
+	}
+}
+
+// slowVoiceSession times the command out while the bot looks for the voice channel
+type slowVoiceSession struct {
+	*deferredSession
+}
+
+func (s slowVoiceSession) StateGuild(guildID string) (*discordgo.Guild, error) {
+	s.timeOut()
+	return s.deferredSession.StateGuild(guildID)
+}
+
+func TestSongVCCommandTimeout(t *testing.T) {
+	c, s, _ := newTestBot()
+	i := testInteraction(discordgo.ApplicationCommandInteractionData{Name: "song-vc"})
+	ds, err := deferInteraction(s, c.DiscordAppID, i.Interaction, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commandHandlers["song-vc"](c, slowVoiceSession{ds}, i)
+	if len(s.InteractionEdits) != 1 || s.InteractionEdits[0].Edit.Content != "Sorry, it's taking too long. Please try again later" {
+		t.Fatalf("expected the timeout message, got %+v", s.InteractionEdits)
+	}
+	if len(s.Followups) != 0 {
+		t.Errorf("got a followup after the timeout: %+v", s.Followups)
+	}
+}
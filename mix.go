@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"github.com/AudDMusic/audd-go"
+	"github.com/Mihonarium/discordgo"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Each request recognizes this many enterprise chunks, so the tracklist is updated every couple of minutes of audio
+const mixWindowChunks = 10
+
+const mixWindowSeconds = mixWindowChunks * enterpriseChunkLength
+
+// The scan stops after this many windows in a row without any audio, in case the API doesn't report the end of the file
+const maxEmptyMixWindows = 3
+
+// Embed descriptions are limited to 4096 characters
+const maxTracklistLength = 4000
+
+type mixTrack struct {
+	Song  audd.RecognitionResult
+	Start int
+	End   int
+}
+
+// mixesRunning keeps a server (or a DM channel) from scanning several mixes at once
+var mixesRunning = map[string]bool{}
+var mixesRunningMu sync.Mutex
+
+var recognizeMixCommand = &discordgo.ApplicationCommand{
+	Type:        discordgo.ChatApplicationCommand,
+	Name:        "recognize-mix",
+	Description: "Recognize every song in a long video or a DJ mix and post the tracklist",
+	Options: []*discordgo.ApplicationCommandOption{{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "url",
+		Description: "The link to the video or the audio",
+		Required:    true,
+	}},
+}
+
+// mixRequested is whether the message asks for the whole file, like "!song full". The word has to follow the trigger,
+// so messages like "!song, I love the full version" aren't mistaken for requests to scan the whole file
+func mixRequested(content string, trigger TriggerRule, locale string) bool {
+	compare := getBodyToCompare(content)
+	_, end := trigger.find(compare, locale)
+	if end < 0 {
+		return false
+	}
+	for _, word := range strings.Fields(compare[end:]) {
+		if word = strings.Trim(word, "?!.,:;\"()"); word != "" {
+			return word == "full" || word == "tracklist"
+		}
+	}
+	return false
+}
+
+// RecognizeMix scans the whole file from the link and calls update with the tracklist embed after every window.
+// The scan stops if update returns false, e.g., when the tracklist can't be posted anymore.
+// The time range from the link or the text, if any, limits the part of the file that's scanned
+func (c *BotConfig) RecognizeMix(link, text string, source RecognitionSource, update func(embed *discordgo.MessageEmbed) bool) {
+	key := source.GuildID
+	if key == "" {
+		key = source.ChannelID
+	}
+	mixesRunningMu.Lock()
+	running := mixesRunning[key]
+	mixesRunning[key] = true
+	mixesRunningMu.Unlock()
+	if running {
+		update(mixEmbed(link, nil, false, "I'm already recognizing a mix on this server. Please wait until it's done"))
+		return
+	}
+	defer func() {
+		mixesRunningMu.Lock()
+		delete(mixesRunning, key)
+		mixesRunningMu.Unlock()
+	}()
+
+	r := requestedTimeRange(link, text, nil)
+	start, end := r.From, r.From+c.MaxMixMinutes*60
+	limited := true
+	if r.To > start && r.To <= end {
+		end, limited = r.To, false
+	}
+	fmt.Println("Recognizing the mix from", link, "from", start, "to", end)
+	if !update(mixEmbed(link, nil, false, "Recognizing the songs…")) {
+		return
+	}
+	var tracks []mixTrack
+	emptyWindows := 0
+	offset := start
+	var note string
+	for ; offset < end; offset += mixWindowSeconds {
+		// The first window was counted before the scan started
+		if offset > start {
+			if reply := c.checkDailyRateLimit(source.GuildID, source.ChannelID, source.UserID); reply != nil {
+				note = "Stopped here. " + reply.Content
+				break
+			}
+		}
+		chunks := mixWindowChunks
+		if remaining := end - offset; remaining < mixWindowSeconds {
+			chunks = (remaining + enterpriseChunkLength - 1) / enterpriseChunkLength
+		}
+		result, err := c.Recognizer.RecognizeLongAudio(link, map[string]string{
+			"skip_first_seconds": strconv.Itoa(offset),
+			"limit":              strconv.Itoa(chunks),
+		})
+		if err != nil {
+			if v, ok := err.(*audd.Error); ok && v.ErrorCode == 501 {
+				// After the first window, no audio means the file has ended
+				if offset == start {
+					note = "Sorry, I couldn't get any audio from it"
+				}
+				break
+			}
+			capture(err)
+			note = "Sorry, there's been an error while processing the audio"
+			break
+		}
+		if len(result) == 0 {
+			emptyWindows++
+		} else {
+			emptyWindows = 0
+		}
+		tracks = c.addMixTracks(tracks, result, offset)
+		if emptyWindows >= maxEmptyMixWindows {
+			note = fmt.Sprintf("Stopped after %d minutes without any music", maxEmptyMixWindows*mixWindowSeconds/60)
+			offset += mixWindowSeconds
+			break
+		}
+		if offset+mixWindowSeconds < end && !update(mixEmbed(link, tracks, false,
+			fmt.Sprintf("Recognizing… %s of up to %s scanned",
+				formatMixTime(offset+mixWindowSeconds-start), formatMixTime(end-start)))) {
+			fmt.Println("Stopped recognizing the mix from", link, "since the tracklist can't be updated")
+			return
+		}
+	}
+	if offset >= end && limited && note == "" {
+		note = fmt.Sprintf("I only scan up to %d minutes on this server", c.MaxMixMinutes)
+	}
+	if note == "" && len(tracks) == 0 {
+		note = "Sorry, I couldn't recognize any songs"
+	}
+	songs := make([]audd.RecognitionResult, 0, len(tracks))
+	for _, track := range tracks {
+		songs = append(songs, track.Song)
+	}
+	source.URL = link
+	capture(History.Add(&source, songs))
+	update(mixEmbed(link, tracks, true, note))
+}
+
+// addMixTracks adds the songs from a window that started at offset, merging the chunks with the same song
+func (c *BotConfig) addMixTracks(tracks []mixTrack, result []audd.RecognitionEnterpriseResult, offset int) []mixTrack {
+	for _, chunk := range result {
+		songs, _ := GetSongs([]audd.RecognitionEnterpriseResult{chunk}, c.MinScore)
+		if len(songs) == 0 {
+			continue
+		}
+		// The chunk offsets are counted from skip_first_seconds
+		chunkStart := offset
+		if seconds, err := TimeStringToSeconds(chunk.Offset); err == nil {
+			chunkStart += seconds
+		}
+		song := songs[0]
+		if len(tracks) > 0 {
+			last := &tracks[len(tracks)-1]
+			if sameSong(last.Song, song) && chunkStart-last.End <= enterpriseChunkLength {
+				last.End = chunkStart + enterpriseChunkLength
+				continue
+			}
+		}
+		tracks = append(tracks, mixTrack{Song: song, Start: chunkStart, End: chunkStart + enterpriseChunkLength})
+	}
+	return tracks
+}
+
+func sameSong(a, b audd.RecognitionResult) bool {
+	if a.SongLink != "" && a.SongLink == b.SongLink {
+		return true
+	}
+	return strings.EqualFold(a.Artist, b.Artist) && strings.EqualFold(a.Title, b.Title)
+}
+
+// mixEmbed is the tracklist with a note about the progress or why the scan stopped
+func mixEmbed(link string, tracks []mixTrack, done bool, note string) *discordgo.MessageEmbed {
+	lines := make([]string, 0, len(tracks))
+	length := 0
+	for i, track := range tracks {
+		line := fmt.Sprintf("`%s` [**%s** by %s](%s)", formatMixTime(track.Start),
+			track.Song.Title, track.Song.Artist, track.Song.SongLink)
+		if length+len(line) > maxTracklistLength {
+			lines = append(lines, fmt.Sprintf("…and %d more", len(tracks)-i))
+			break
+		}
+		lines = append(lines, line)
+		length += len(line) + 1
+	}
+	embed := &discordgo.MessageEmbed{
+		Title:       "Tracklist: " + linkName(link),
+		URL:         link,
+		Description: strings.Join(lines, "\n"),
+		Color:       3066993,
+		Footer: &discordgo.MessageEmbedFooter{
+			Text:    "Powered by AudD Music Recognition API",
+			IconURL: "https://audd.io/pride_logo_outline_100px.png",
+		},
+	}
+	if note != "" {
+		embed.Description = strings.TrimSpace(embed.Description + "\n\n" + note)
+	}
+	if done {
+		embed.Footer.Text = fmt.Sprintf("%d songs found. %s", len(tracks), embed.Footer.Text)
+	}
+	return embed
+}
+
+func formatMixTime(seconds int) string {
+	return SecondsToTimeString(seconds, seconds >= 3600)
+}
+
+// MixFromMessage handles "!song full": it posts the tracklist and keeps editing it as the scan goes
+func (c *BotConfig) MixFromMessage(s Session, m *discordgo.Message, source RecognitionSource) bool {
+	links, err := c.GetLinksFromMessage(s, m)
+	if capture(err) {
+		return false
+	}
+	var link string
+	for _, l := range links {
+		if !strings.Contains(l, "https://lis.tn/") {
+			link = l
+			break
+		}
+	}
+	if link == "" || c.MaxMixMinutes <= 0 {
+		return false
+	}
+	if reply := c.checkRateLimit(source.GuildID, source.ChannelID, source.UserID, m.Reference()); reply != nil {
+		c.sendMessage(s, m.ChannelID, reply, false)
+		return true
+	}
+	var sent *discordgo.Message
+	c.RecognizeMix(link, m.Content, source, func(embed *discordgo.MessageEmbed) bool {
+		if sent == nil {
+			sent, err = s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+				Embeds:    []*discordgo.MessageEmbed{embed},
+				Reference: m.Reference(),
+			})
+			return !capture(err)
+		}
+		_, err := s.ChannelMessageEditComplex(&discordgo.MessageEdit{
+			Embeds:  []*discordgo.MessageEmbed{embed},
+			ID:      sent.ID,
+			Channel: sent.ChannelID,
+		})
+		return !capture(err)
+	})
+	return true
+}
+
+func (c *BotConfig) RecognizeMixCommand(s Session, i *discordgo.InteractionCreate) {
+	var link string
+	for _, option := range i.ApplicationCommandData().Options {
+		if option.Name == "url" {
+			link = strings.TrimSpace(option.StringValue())
+		}
+	}
+	respond := func(content string) {
+		capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{Content: content, Flags: 1 << 6},
+		}))
+	}
+	if c.MaxMixMinutes <= 0 {
+		respond("Sorry, recognizing mixes is disabled")
+		return
+	}
+	if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+		respond("Please send a link to a video or an audio")
+		return
+	}
+	if reply := c.checkRateLimit(i.GuildID, i.ChannelID, interactionUserID(i), nil); reply != nil {
+		respond(reply.Content)
+		return
+	}
+	responded := false
+	var sent *discordgo.Message
+	c.RecognizeMix(link, "", RecognitionSource{
+		GuildID:   i.GuildID,
+		ChannelID: i.ChannelID,
+		UserID:    interactionUserID(i),
+	}, func(embed *discordgo.MessageEmbed) bool {
+		if !responded {
+			responded = true
+			return !capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{Embeds: []*discordgo.MessageEmbed{embed}},
+			}))
+		}
+		if sent != nil {
+			_, err := s.ChannelMessageEditComplex(&discordgo.MessageEdit{
+				Embeds:  []*discordgo.MessageEmbed{embed},
+				ID:      sent.ID,
+				Channel: sent.ChannelID,
+			})
+			return !capture(err)
+		}
+		_, err := s.InteractionResponseEdit(c.DiscordAppID, i.Interaction, &discordgo.WebhookEdit{
+			Embeds: []*discordgo.MessageEmbed{embed},
+		})
+		if err == nil {
+			return true
+		}
+		// The response can't be edited after the command times out, so the scan goes on in a message
+		fmt.Println("Continuing the tracklist in a message:", err)
+		sent, err = s.ChannelMessageSendComplex(i.ChannelID, &discordgo.MessageSend{
+			Embeds: []*discordgo.MessageEmbed{embed},
+		})
+		return !capture(err)
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"github.com/Mihonarium/discordgo"
+	"strings"
+	"testing"
+)
+
+func TestMixRequested(t *testing.T) {
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{"!song full", true},
+		{"!song full https://example.com/mix.mp3", true},
+		{"!song FULL?", true},
+		{"whats the song? tracklist please", true},
+		{"!song (full)", true},
+		{"hey, !song full", true},
+		{"!song", false},
+		{"!song https://example.com/full.mp3", false},
+		{"!song https://example.com/mix.mp3 full", false},
+		{"!song fully", false},
+		{"!song, I love the full version", false},
+		{"the full tracklist? whats the song", false},
+	}
+	triggers := []TriggerRule{{Pattern: "!song"}, {Pattern: "whats the song"}}
+	for _, tt := range tests {
+		var trigger TriggerRule
+		for _, rule := range triggers {
+			if rule.Match(getBodyToCompare(tt.content), "") {
+				trigger = rule
+			}
+		}
+		if got := mixRequested(tt.content, trigger, ""); got != tt.want {
+			t.Errorf("mixRequested(%q) = %t, want %t", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestMixFromMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []*discordgo.Message
+		message *discordgo.Message
+	}{
+		{
+			name:    "inline",
+			message: testMessage("1", "!song full https://example.com/mix.mp3"),
+		},
+		{
+			name:    "reply",
+			history: []*discordgo.Message{testMessage("1", "https://example.com/mix.mp3")},
+			message: reply(testMessage("2", "!song full"), "1"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, recognizer := newTestBot()
+			c.MaxMixMinutes = 2
+			for _, m := range tt.history {
+				s.AddMessage(m)
+			}
+			s.AddMessage(tt.message)
+			c.messageCreate(s, &discordgo.MessageCreate{Message: tt.message})
+			if len(recognizer.Requests) != 1 || recognizer.Requests[0].Source != "https://example.com/mix.mp3" ||
+				recognizer.Requests[0].Parameters["limit"] != "10" {
+				t.Fatalf("expected one request for the whole mix, got %+v", recognizer.Requests)
+			}
+			if len(s.Sent) != 1 || len(s.Sent[0].Message.Embeds) != 1 ||
+				!strings.HasPrefix(s.Sent[0].Message.Embeds[0].Title, "Tracklist: ") {
+				t.Fatalf("expected the tracklist, got %+v", s.Sent)
+			}
+			if len(s.Edits) == 0 {
+				t.Fatal("the tracklist wasn't updated")
+			}
+			final := s.Edits[len(s.Edits)-1].Embeds[0]
+			if !strings.Contains(final.Description, "Warriors") || !strings.Contains(final.Footer.Text, "1 songs found") {
+				t.Errorf("the final tracklist is %q, %q", final.Description, final.Footer.Text)
+			}
+		})
+	}
+}
+
+// timingOutSession times the command out right after the first response
+type timingOutSession struct {
+	*deferredSession
+}
+
+func (s timingOutSession) InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse) error {
+	err := s.deferredSession.InteractionRespond(interaction, resp)
+	s.timeOut()
+	return err
+}
+
+func TestRecognizeMixCommandTimeout(t *testing.T) {
+	mixCommand := testInteraction(discordgo.ApplicationCommandInteractionData{
+		Name: "recognize-mix",
+		Options: []*discordgo.ApplicationCommandInteractionDataOption{{
+			Name: "url", Type: discordgo.ApplicationCommandOptionString, Value: "https://example.com/mix.mp3",
+		}},
+	})
+
+	t.Run("before the response", func(t *testing.T) {
+		c, s, recognizer := newTestBot()
+		ds, err := deferInteraction(s, c.DiscordAppID, mixCommand.Interaction, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds.timeOut()
+		c.RecognizeMixCommand(ds, mixCommand)
+		if len(recognizer.Requests) != 0 {
+			t.Errorf("the mix was scanned after the command timed out: %+v", recognizer.Requests)
+		}
+	})
+
+	t.Run("after the response", func(t *testing.T) {
+		c, s, recognizer := newTestBot()
+		c.MaxMixMinutes = 4
+		ds, err := deferInteraction(s, c.DiscordAppID, mixCommand.Interaction, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.RecognizeMixCommand(timingOutSession{ds}, mixCommand)
+		if len(recognizer.Requests) != 2 {
+			t.Errorf("expected the whole mix to be scanned, got %+v", recognizer.Requests)
+		}
+		if len(s.Sent) != 1 || len(s.Edits) != 1 {
+			t.Fatalf("expected the tracklist to go on in a message, got %+v and the edits %+v", s.Sent, s.Edits)
+		}
+		final := s.Edits[0].Embeds[0]
+		if !strings.Contains(final.Description, "Warriors") || !strings.Contains(final.Footer.Text, "songs found") {
+			t.Errorf("the final tracklist is %q, %q", final.Description, final.Footer.Text)
+		}
+	})
+}
+
+func TestMixDailyRateLimit(t *testing.T) {
+	limiter := Limiter
+	Limiter = NewRateLimiter()
+	t.Cleanup(func() { Limiter = limiter })
+
+	c, s, recognizer := newTestBot()
+	c.MaxMixMinutes = 10
+	c.UserRateLimit = RateLimit{PerMinute: 1, Burst: 1, Daily: 3}
+	m := testMessage("1", "!song full https://example.com/mix.mp3")
+	s.AddMessage(m)
+	c.messageCreate(s, &discordgo.MessageCreate{Message: m})
+	// Every window counts against the daily limit, but not against the per-minute one
+	if len(recognizer.Requests) != 3 {
+		t.Errorf("got %d requests, want 3", len(recognizer.Requests))
+	}
+	if len(s.Edits) == 0 {
+		t.Fatal("the tracklist wasn't updated")
+	}
+	final := s.Edits[len(s.Edits)-1].Embeds[0]
+	if !strings.Contains(final.Description, "Stopped here. You've made a lot of requests recently") {
+		t.Errorf("the final tracklist is %q", final.Description)
+	}
+	if reply := c.checkRateLimit(testGuildID, testChannelID, testUserID, nil); reply == nil {
+		t.Error("the mix wasn't counted against the daily limit")
+	}
+}
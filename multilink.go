@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"github.com/AudDMusic/audd-go"
+	"github.com/Mihonarium/discordgo"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// A message can have up to 10 embeds, and each link gets one
+const maxLinksPerMessageLimit = 10
+
+type linkRecognition struct {
+	Link   string
+	At     string
+	Result []audd.RecognitionEnterpriseResult
+	Err    error
+}
+
+// recognizeLinks recognizes the songs from every link in parallel and replies with the songs grouped by link
+func (c *BotConfig) recognizeLinks(m *discordgo.Message, links []string, source RecognitionSource,
+	r *TimeRange) *discordgo.MessageSend {
+	filtered := make([]string, 0, len(links))
+	for _, link := range links {
+		// Our own replies have lis.tn links, and the same link can be posted several times
+		if strings.Contains(link, "https://lis.tn/") || stringInSlice(filtered, link) {
+			continue
+		}
+		filtered = append(filtered, link)
+	}
+	links = filtered
+	if len(links) == 0 {
+		return nil
+	}
+	var skipped string
+	if len(links) > c.MaxLinksPerMessage {
+		skipped = fmt.Sprintf("I only recognize the first %d links from a message.", c.MaxLinksPerMessage)
+		links = links[:c.MaxLinksPerMessage]
+	}
+	for i := range links {
+		reply := c.checkRateLimit(source.GuildID, source.ChannelID, source.UserID, m.Reference())
+		if reply == nil {
+			continue
+		}
+		if i == 0 {
+			return reply
+		}
+		skipped = fmt.Sprintf("I only recognized %d of the links: %s", i, reply.Content)
+		links = links[:i]
+		break
+	}
+
+	recognitions := make([]linkRecognition, len(links))
+	semaphore := make(chan struct{}, c.MaxParallelRecognitions)
+	var wg sync.WaitGroup
+	for i, link := range links {
+		wg.Add(1)
+		go func(i int, link string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			fmt.Println("Recognizing from", link)
+			parameters, at := recognitionParameters(link, requestedTimeRange(link, m.Content, r))
+			result, err := c.Recognizer.RecognizeLongAudio(link, parameters)
+			recognitions[i] = linkRecognition{Link: link, At: at, Result: result, Err: err}
+		}(i, link)
+	}
+	wg.Wait()
+
+	response := &discordgo.MessageSend{Reference: m.Reference(), Content: skipped}
+	found := false
+	for i, r := range recognitions {
+		songs, _ := GetSongs(r.Result, c.MinScore)
+		linkSource := source
+		linkSource.URL = r.Link
+		capture(History.Add(&linkSource, songs))
+		var description string
+		switch {
+		case len(songs) > 0:
+			found = true
+			texts := make([]string, 0, len(songs))
+			for _, song := range songs {
+				texts = append(texts, songText(song, true))
+			}
+			description = strings.Join(texts, "\n\n")
+		case r.Err != nil:
+			if v, ok := r.Err.(*audd.Error); ok && v.ErrorCode == 501 {
+				description = "Sorry, I couldn't get any audio from it"
+			} else {
+				capture(r.Err)
+				description = "Sorry, there's been an error while processing the audio"
+			}
+		default:
+			description = fmt.Sprintf("Sorry, I couldn't recognize the song at %s.", r.At)
+		}
+		response.Embeds = append(response.Embeds, &discordgo.MessageEmbed{
+			Title:       fmt.Sprintf("%d. %s", i+1, linkName(r.Link)),
+			URL:         r.Link,
+			Description: description,
+			Color:       3066993,
+		})
+	}
+	response.Embeds[len(response.Embeds)-1].Footer = &discordgo.MessageEmbedFooter{
+		Text:    "Powered by AudD Music Recognition API",
+		IconURL: "https://audd.io/pride_logo_outline_100px.png",
+	}
+	response.Components = GetButtons(found)
+	return response
+}
+
+// linkName is the file name for attachments and the host with the path for other links
+func linkName(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	if isDiscordAttachment(link) {
+		return path.Base(u.Path)
+	}
+	name := u.Host + u.Path
+	if len(name) > 100 {
+		name = name[:100] + "…"
+	}
+	return name
+}
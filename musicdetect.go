@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+)
+
+// Frames quieter than this RMS (about -40 dBFS) are considered silent
+const silenceRMS = 330
+
+// If no stream scores at least this much, probably nobody is playing music, and mixing everyone is the best guess
+const minMusicScore = 0.35
+
+// musicScore estimates how much the audio looks like music rather than speech, from 0 to 1.
+// Music is mostly continuous and has a steady loudness, while speech has frequent pauses between phrases and
+// syllables, and background noise has a flat spectrum
+func musicScore(pcm []int16) float64 {
+	frames := len(pcm) / frameSamples
+	if frames == 0 {
+		return 0
+	}
+	levels := make([]float64, frames)
+	active, gaps := 0, 0
+	for i := 0; i < frames; i++ {
+		levels[i] = rms(pcm[i*frameSamples : (i+1)*frameSamples])
+		if levels[i] >= silenceRMS {
+			active++
+		} else if i > 0 && levels[i-1] >= silenceRMS {
+			gaps++
+		}
+	}
+	if active == 0 {
+		return 0
+	}
+	// The stream is padded with silence before the speaker started and after they stopped, so only the part between
+	// the first and the last sound is measured
+	first, last := 0, frames-1
+	for levels[first] < silenceRMS {
+		first++
+	}
+	for levels[last] < silenceRMS {
+		last--
+	}
+	span := last - first + 1
+	continuity := float64(active) / float64(span)
+	gapsPerSecond := float64(gaps) / (float64(span) / framesInSecond)
+
+	var sum, sumSquares float64
+	for _, level := range levels[first : last+1] {
+		sum += level
+		sumSquares += level * level
+	}
+	mean := sum / float64(span)
+	variation := math.Sqrt(math.Max(sumSquares/float64(span)-mean*mean, 0)) / mean
+
+	flatness := spectralFlatness(pcm[first*frameSamples : (last+1)*frameSamples])
+
+	score := 0.4*continuity +
+		0.3*(1-math.Min(gapsPerSecond/3, 1)) +
+		0.3*(1-math.Min(variation/1.5, 1))
+	return score * (1 - flatness)
+}
+
+// spectralFlatness is the average ratio of the geometric to the arithmetic mean of the power spectrum:
+// close to 1 for noise and close to 0 for tonal sounds
+func spectralFlatness(pcm []int16) float64 {
+	const size = 1024
+	const maxWindows = 50
+	windows := len(pcm) / size
+	if windows == 0 {
+		return 0
+	}
+	step := 1
+	if windows > maxWindows {
+		step = windows / maxWindows
+	}
+	total, counted := 0.0, 0
+	buf := make([]complex128, size)
+	for w := 0; w < windows; w += step {
+		silent := true
+		for i := range buf {
+			sample := float64(pcm[w*size+i])
+			if math.Abs(sample) >= silenceRMS {
+				silent = false
+			}
+			// Hann window
+			buf[i] = complex(sample*0.5*(1-math.Cos(2*math.Pi*float64(i)/(size-1))), 0)
+		}
+		if silent {
+			continue
+		}
+		fft(buf)
+		logSum, sum := 0.0, 0.0
+		for _, v := range buf[1 : size/2] {
+			power := real(v)*real(v) + imag(v)*imag(v) + 1e-9
+			logSum += math.Log(power)
+			sum += power
+		}
+		n := float64(size/2 - 1)
+		total += math.Exp(logSum/n) / (sum / n)
+		counted++
+	}
+	if counted == 0 {
+		return 0
+	}
+	return total / float64(counted)
+}
+
+// fft is an in-place radix-2 FFT; len(a) must be a power of 2
+func fft(a []complex128) {
+	n := len(a)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+	for length := 2; length <= n; length <<= 1 {
+		w := cmplx.Exp(complex(0, -2*math.Pi/float64(length)))
+		for i := 0; i < n; i += length {
+			wn := complex(1, 0)
+			for j := 0; j < length/2; j++ {
+				u, v := a[i+j], a[i+j+length/2]*wn
+				a[i+j], a[i+j+length/2] = u+v, u-v
+				wn *= w
+			}
+		}
+	}
+}
+
+// mostMusicalStream returns the stream that looks the most like music, or nil if none of them does
+func mostMusicalStream(streams []speakerStream) []int16 {
+	var best []int16
+	bestUserID, bestScore := "", 0.0
+	for _, stream := range streams {
+		if score := musicScore(stream.PCM); score > bestScore {
+			best, bestUserID, bestScore = stream.PCM, stream.UserID, score
+		}
+	}
+	if bestScore < minMusicScore {
+		return nil
+	}
+	fmt.Printf("Playing music: %s (score %.2f)\n", bestUserID, bestScore)
+	return best
+}
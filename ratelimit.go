@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Mihonarium/discordgo"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket: Burst requests can be made at once, and PerMinute requests are added back every minute.
+// Daily caps the requests per UTC day. Zero values mean no limit
+type RateLimit struct {
+	PerMinute float64 `json:"per_minute"`
+	Burst     int     `json:"burst"`
+	Daily     int     `json:"daily"`
+}
+
+func (l RateLimit) String() string {
+	if l.PerMinute <= 0 && l.Daily <= 0 {
+		return "no limit"
+	}
+	var parts []string
+	if l.PerMinute > 0 {
+		parts = append(parts, fmt.Sprintf("%g per minute, up to %d at once", l.PerMinute, l.burst()))
+	}
+	if l.Daily > 0 {
+		parts = append(parts, fmt.Sprintf("%d per day", l.Daily))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// within returns the limit made no looser than max, so servers can only make the global limits stricter
+func (l RateLimit) within(max RateLimit) RateLimit {
+	if max.PerMinute > 0 && (l.PerMinute <= 0 || l.PerMinute > max.PerMinute) {
+		l.PerMinute = max.PerMinute
+	}
+	if max.PerMinute > 0 && l.burst() > max.burst() {
+		l.Burst = max.burst()
+	}
+	if max.Daily > 0 && (l.Daily <= 0 || l.Daily > max.Daily) {
+		l.Daily = max.Daily
+	}
+	return l
+}
+
+func (l RateLimit) burst() int {
+	if l.Burst < 1 {
+		return 1
+	}
+	return l.Burst
+}
+
+type rateBucket struct {
+	Tokens  float64
+	Updated time.Time
+	Day     string
+	Today   int
+}
+
+// RateLimiter counts the recognition requests of users, channels and servers. The counters are only kept in memory
+type RateLimiter struct {
+	buckets map[string]*rateBucket
+	mu      sync.Mutex
+}
+
+var Limiter = NewRateLimiter()
+
+// Buckets that weren't used today are removed when there are more than this many of them
+const rateBucketsCleanupSize = 10000
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: map[string]*rateBucket{}}
+}
+
+type rateLimitedKey struct {
+	Key   string
+	Limit RateLimit
+}
+
+// Allow takes a request from every bucket if none of them is empty. Otherwise, it returns the time when all the
+// buckets will allow a request again and the key of the bucket that has to wait the longest
+func (r *RateLimiter) Allow(now time.Time, keys ...rateLimitedKey) (bool, time.Time, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.buckets) > rateBucketsCleanupSize {
+		r.cleanup(now)
+	}
+	day := now.UTC().Format("2006-01-02")
+	var retryAt time.Time
+	var limitedBy string
+	for _, k := range keys {
+		b := r.bucket(k, now, day)
+		var wait time.Time
+		if k.Limit.Daily > 0 && b.Today >= k.Limit.Daily {
+			y, m, d := now.UTC().Date()
+			wait = time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+		} else if k.Limit.PerMinute > 0 && b.Tokens < 1 {
+			wait = now.Add(time.Duration((1 - b.Tokens) / k.Limit.PerMinute * float64(time.Minute)))
+		}
+		if wait.After(retryAt) {
+			retryAt, limitedBy = wait, k.Key
+		}
+	}
+	if !retryAt.IsZero() {
+		return false, retryAt, limitedBy
+	}
+	for _, k := range keys {
+		b := r.buckets[k.Key]
+		if k.Limit.PerMinute > 0 {
+			b.Tokens--
+		}
+		b.Today++
+	}
+	return true, time.Time{}, ""
+}
+
+// bucket returns the refilled bucket for the key; r.mu must be held
+func (r *RateLimiter) bucket(k rateLimitedKey, now time.Time, day string) *rateBucket {
+	burst := float64(k.Limit.burst())
+	b, exists := r.buckets[k.Key]
+	if !exists {
+		b = &rateBucket{Tokens: burst, Updated: now, Day: day}
+		r.buckets[k.Key] = b
+	}
+	// Without a per-minute limit, e.g., when only the daily limits are checked, the refill is left for later
+	if k.Limit.PerMinute > 0 {
+		b.Tokens = math.Min(burst, b.Tokens+now.Sub(b.Updated).Minutes()*k.Limit.PerMinute)
+		b.Updated = now
+	}
+	if b.Day != day {
+		b.Day, b.Today = day, 0
+	}
+	return b
+}
+
+func (r *RateLimiter) cleanup(now time.Time) {
+	day := now.UTC().Format("2006-01-02")
+	for key, b := range r.buckets {
+		// Forgetting a bucket can only let a few more requests through, and an hour is enough to refill most of them
+		if b.Day != day && now.Sub(b.Updated) > time.Hour {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// rateLimits returns the limits by their /settings scope names
+func (c *BotConfig) rateLimits() map[string]*RateLimit {
+	return map[string]*RateLimit{"user": &c.UserRateLimit, "channel": &c.ChannelRateLimit, "server": &c.GuildRateLimit}
+}
+
+// checkRateLimit returns a reply if the user, the channel, or the server made too many recognition requests
+func (c *BotConfig) checkRateLimit(guildID, channelID, userID string, reference *discordgo.MessageReference) *discordgo.MessageSend {
+	return rateLimitReply(guildID, c.rateLimitKeys(guildID, channelID, userID), reference)
+}
+
+// checkDailyRateLimit only counts the request against the daily limits. Every window of a mix is a recognition,
+// so long mixes are counted by their length, but the per-minute limits would stop most mixes after a few windows
+func (c *BotConfig) checkDailyRateLimit(guildID, channelID, userID string) *discordgo.MessageSend {
+	keys := c.rateLimitKeys(guildID, channelID, userID)
+	for i := range keys {
+		keys[i].Limit.PerMinute = 0
+	}
+	return rateLimitReply(guildID, keys, nil)
+}
+
+func (c *BotConfig) rateLimitKeys(guildID, channelID, userID string) []rateLimitedKey {
+	// The limits come from the server settings, so the requests of a user are counted separately in every server
+	keys := []rateLimitedKey{{"user:" + guildID + ":" + userID, c.UserRateLimit},
+		{"channel:" + channelID, c.ChannelRateLimit}}
+	if guildID != "" {
+		keys = append(keys, rateLimitedKey{"guild:" + guildID, c.GuildRateLimit})
+	}
+	return keys
+}
+
+func rateLimitReply(guildID string, keys []rateLimitedKey, reference *discordgo.MessageReference) *discordgo.MessageSend {
+	allowed, retryAt, limitedBy := Limiter.Allow(time.Now(), keys...)
+	if allowed {
+		return nil
+	}
+	fmt.Println("Rate limited:", limitedBy)
+	who := "You've"
+	switch limitedBy {
+	case keys[1].Key:
+		who = "This channel has"
+	case "guild:" + guildID:
+		who = "This server has"
+	}
+	return &discordgo.MessageSend{
+		Content: fmt.Sprintf("%s made a lot of requests recently. Please try again <t:%d:R>",
+			who, int64(math.Ceil(float64(retryAt.UnixNano())/float64(time.Second)))),
+		Reference: reference,
+	}
+}
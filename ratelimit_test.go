@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitWithin(t *testing.T) {
+	tests := []struct {
+		name       string
+		limit, max RateLimit
+		want       RateLimit
+	}{
+		{"no global limit", RateLimit{PerMinute: 10, Burst: 20, Daily: 100}, RateLimit{},
+			RateLimit{PerMinute: 10, Burst: 20, Daily: 100}},
+		{"a stricter limit", RateLimit{PerMinute: 1, Burst: 2, Daily: 10}, RateLimit{PerMinute: 5, Burst: 5, Daily: 50},
+			RateLimit{PerMinute: 1, Burst: 2, Daily: 10}},
+		{"a looser limit", RateLimit{PerMinute: 10, Burst: 20, Daily: 100}, RateLimit{PerMinute: 5, Burst: 5, Daily: 50},
+			RateLimit{PerMinute: 5, Burst: 5, Daily: 50}},
+		{"no limit on a server", RateLimit{}, RateLimit{PerMinute: 5, Burst: 5, Daily: 50},
+			RateLimit{PerMinute: 5, Daily: 50}},
+		{"the global burst defaults to 1", RateLimit{PerMinute: 1, Burst: 3}, RateLimit{PerMinute: 5},
+			RateLimit{PerMinute: 1, Burst: 1}},
+		{"only the daily limit", RateLimit{PerMinute: 10, Burst: 20}, RateLimit{Daily: 50},
+			RateLimit{PerMinute: 10, Burst: 20, Daily: 50}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.limit.within(tt.max); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	start := time.Date(2024, 5, 1, 23, 50, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		limit RateLimit
+		// after is the time of each request since start
+		after []time.Duration
+		want  []bool
+	}{
+		{"the burst", RateLimit{PerMinute: 1, Burst: 2},
+			[]time.Duration{0, 0, 0}, []bool{true, true, false}},
+		{"the refill", RateLimit{PerMinute: 2, Burst: 1},
+			[]time.Duration{0, 10 * time.Second, 40 * time.Second, 50 * time.Second}, []bool{true, false, true, false}},
+		{"the refill stops at the burst", RateLimit{PerMinute: 1, Burst: 2},
+			[]time.Duration{0, time.Hour, time.Hour, time.Hour}, []bool{true, true, true, false}},
+		{"a rejected request isn't counted", RateLimit{PerMinute: 1, Burst: 1},
+			[]time.Duration{0, 30 * time.Second, time.Minute}, []bool{true, false, true}},
+		{"the daily limit", RateLimit{Daily: 2},
+			[]time.Duration{0, time.Minute, 2 * time.Minute}, []bool{true, true, false}},
+		{"the daily limit resets at midnight UTC", RateLimit{Daily: 1},
+			[]time.Duration{0, 9 * time.Minute, 10 * time.Minute}, []bool{true, false, true}},
+		{"no limit", RateLimit{},
+			[]time.Duration{0, 0, 0}, []bool{true, true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRateLimiter()
+			for i, after := range tt.after {
+				allowed, retryAt, limitedBy := r.Allow(start.Add(after), rateLimitedKey{"user", tt.limit})
+				if allowed != tt.want[i] {
+					t.Fatalf("request %d: got %t, want %t", i, allowed, tt.want[i])
+				}
+				if !allowed && (limitedBy != "user" || !retryAt.After(start.Add(after))) {
+					t.Errorf("request %d: limited by %q until %s", i, limitedBy, retryAt)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterAllowRetryAt(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r := NewRateLimiter()
+	user := rateLimitedKey{"user", RateLimit{PerMinute: 2, Burst: 1}}
+	channel := rateLimitedKey{"channel", RateLimit{Daily: 1}}
+	if allowed, _, _ := r.Allow(now, user, channel); !allowed {
+		t.Fatal("the first request wasn't allowed")
+	}
+	// The key that has to wait the longest is returned
+	allowed, retryAt, limitedBy := r.Allow(now, user, channel)
+	if allowed || limitedBy != "channel" || !retryAt.Equal(time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %t, %s, %q", allowed, retryAt, limitedBy)
+	}
+	allowed, retryAt, limitedBy = r.Allow(now, user)
+	if allowed || limitedBy != "user" || !retryAt.Equal(now.Add(30*time.Second)) {
+		t.Errorf("got %t, %s, %q", allowed, retryAt, limitedBy)
+	}
+}
+
+func TestCheckRateLimitPerServer(t *testing.T) {
+	limiter := Limiter
+	Limiter = NewRateLimiter()
+	t.Cleanup(func() { Limiter = limiter })
+
+	strict := &BotConfig{UserRateLimit: RateLimit{PerMinute: 1, Burst: 1}}
+	loose := &BotConfig{UserRateLimit: RateLimit{PerMinute: 1, Burst: 5}}
+	if reply := loose.checkRateLimit("a", "a1", testUserID, nil); reply != nil {
+		t.Fatalf("the first request was limited: %s", reply.Content)
+	}
+	if reply := loose.checkRateLimit("a", "a2", testUserID, nil); reply != nil {
+		t.Fatalf("the second request was limited: %s", reply.Content)
+	}
+	// A stricter server doesn't take the requests from the other server into account
+	if reply := strict.checkRateLimit("b", "b1", testUserID, nil); reply != nil {
+		t.Fatalf("the request in another server was limited: %s", reply.Content)
+	}
+	if reply := strict.checkRateLimit("b", "b1", testUserID, nil); reply == nil {
+		t.Error("the second request in the strict server wasn't limited")
+	}
+	if reply := loose.checkRateLimit("a", "a3", testUserID, nil); reply != nil {
+		t.Errorf("the strict server limited the requests in the other one: %s", reply.Content)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Mihonarium/discordgo"
+	"time"
+)
+
+// Older media is unlikely to be what someone asks about
+const recentMediaMaxAge = time.Hour
+
+// findRecentMedia returns the latest message with media among the last ScanRecentMessages messages before m
+func (c *BotConfig) findRecentMedia(s Session, m *discordgo.Message) (*discordgo.Message, []string) {
+	if c.ScanRecentMessages <= 0 {
+		return nil, nil
+	}
+	messages, err := s.ChannelMessages(m.ChannelID, c.ScanRecentMessages, m.ID, "", "")
+	if capture(err) {
+		return nil, nil
+	}
+	botID := s.BotUserID()
+	// The messages are sorted from the newest
+	for _, recent := range messages {
+		if time.Since(recent.Timestamp) > recentMediaMaxAge {
+			break
+		}
+		if recent.Author != nil && recent.Author.ID == botID {
+			continue
+		}
+		if links := linksFromMessage(recent); len(links) > 0 {
+			return recent, links
+		}
+	}
+	return nil, nil
+}
+
+// recentMediaConfirmation tells which message the bot found, so it's clear what it recognized
+func recentMediaConfirmation(guildID string, recent *discordgo.Message) string {
+	if guildID == "" {
+		guildID = "@me"
+	}
+	author := "someone"
+	if recent.Author != nil {
+		author = "**" + recent.Author.Username + "**"
+	}
+	return fmt.Sprintf("Recognizing [the clip](https://discord.com/channels/%s/%s/%s) posted by %s <t:%d:R>",
+		guildID, recent.ChannelID, recent.ID, author, recent.Timestamp.Unix())
+}
+
+// inVoiceChannel returns whether the user is on a voice channel of the server
+func inVoiceChannel(s Session, guildID, userID string) bool {
+	g, err := s.StateGuild(guildID)
+	if err != nil {
+		return false
+	}
+	for _, vs := range g.VoiceStates {
+		if vs.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Mihonarium/discordgo"
+	"strings"
+	"sync"
+)
+
+// The version of discordgo we use doesn't have the attachment option type
+const applicationCommandOptionAttachment discordgo.ApplicationCommandOptionType = 11
+
+// resolvedAttachments keeps the files attached to slash commands by the interaction ID until the command is handled,
+// since discordgo doesn't parse them
+var resolvedAttachments = map[string]map[string]*discordgo.MessageAttachment{}
+var resolvedAttachmentsMu sync.Mutex
+
+var privateOption = &discordgo.ApplicationCommandOption{
+	Type:        discordgo.ApplicationCommandOptionBoolean,
+	Name:        "private",
+	Description: "Only show the result to you",
+}
+
+var recognizeCommand = &discordgo.ApplicationCommand{
+	Type:        discordgo.ChatApplicationCommand,
+	Name:        "recognize",
+	Description: "Recognize the song from a link or a file",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "url",
+			Description: "The link to the video or the audio",
+		},
+		{
+			Type:        applicationCommandOptionAttachment,
+			Name:        "attachment",
+			Description: "The video or the audio file",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "from",
+			Description: "Where the song starts, e.g., 1:30 or 1m30s",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "to",
+			Description: "Where the song ends, e.g., 2:00",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionBoolean,
+			Name:        "at_the_end",
+			Description: "Recognize the song at the end",
+		},
+		privateOption,
+	},
+}
+
+// interactionEvent handles the raw interaction events, so the attachments can be read before the command is handled
+func (c *BotConfig) interactionEvent(s Session, e *discordgo.Event) {
+	i, ok := e.Struct.(*discordgo.InteractionCreate)
+	if !ok {
+		return
+	}
+	if i.Type == discordgo.InteractionApplicationCommand {
+		var raw struct {
+			Data struct {
+				Resolved struct {
+					Attachments map[string]*discordgo.MessageAttachment `json:"attachments"`
+				} `json:"resolved"`
+			} `json:"data"`
+		}
+		if !capture(json.Unmarshal(e.RawData, &raw)) && len(raw.Data.Resolved.Attachments) > 0 {
+			resolvedAttachmentsMu.Lock()
+			resolvedAttachments[i.ID] = raw.Data.Resolved.Attachments
+			resolvedAttachmentsMu.Unlock()
+			defer func() {
+				resolvedAttachmentsMu.Lock()
+				delete(resolvedAttachments, i.ID)
+				resolvedAttachmentsMu.Unlock()
+			}()
+		}
+	}
+	c.interactionCreate(s, i)
+}
+
+func resolvedAttachment(interactionID, attachmentID string) *discordgo.MessageAttachment {
+	resolvedAttachmentsMu.Lock()
+	defer resolvedAttachmentsMu.Unlock()
+	return resolvedAttachments[interactionID][attachmentID]
+}
+
+func (c *BotConfig) RecognizeCommand(s Session, i *discordgo.InteractionCreate) {
+	respond := func(content string) {
+		capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{Content: content, Flags: 1 << 6},
+		}))
+	}
+	m := &discordgo.Message{ID: i.ID, ChannelID: i.ChannelID, GuildID: i.GuildID}
+	var from, to, link string
+	atTheEnd := false
+	for _, option := range i.ApplicationCommandData().Options {
+		switch option.Name {
+		case "url":
+			link = strings.TrimSpace(option.StringValue())
+		case "attachment":
+			id, _ := option.Value.(string)
+			if a := resolvedAttachment(i.ID, id); a != nil {
+				m.Attachments = append(m.Attachments, a)
+			}
+		case "from":
+			from = option.StringValue()
+		case "to":
+			to = option.StringValue()
+		case "at_the_end":
+			atTheEnd = option.BoolValue()
+		}
+	}
+	if link != "" && !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+		respond("Please send a link to a video or an audio")
+		return
+	}
+	if link == "" && len(m.Attachments) == 0 {
+		respond("Please send a link or attach a file")
+		return
+	}
+	// The time from the options is used instead of the time in the link
+	r, problem := commandTimeRange(from, to, atTheEnd)
+	if problem != "" {
+		respond(problem)
+		return
+	}
+	m.Content = link
+	links, err := c.GetLinksFromMessage(s, m)
+	if capture(err) {
+		respond("Sorry, I got an error from Discord when I tried to get the file")
+		return
+	}
+	reacted, message := c.HandleLinks(m, links, RecognitionSource{
+		GuildID:   i.GuildID,
+		ChannelID: i.ChannelID,
+		UserID:    interactionUserID(i),
+	}, true, r)
+	if !reacted || message == nil {
+		respond("Sorry, I couldn't get any audio from it")
+		return
+	}
+	capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: interactionResponseData(message),
+	}))
+}
+
+// commandTimeRange converts the options of /recognize to the time range, or returns what's wrong with them.
+// The range is nil if none of the options are set
+func commandTimeRange(from, to string, atTheEnd bool) (r *TimeRange, problem string) {
+	if atTheEnd {
+		if from != "" || to != "" {
+			return nil, "Please choose either the time or at_the_end"
+		}
+		return &TimeRange{FromEnd: true}, ""
+	}
+	if from == "" && to == "" {
+		return nil, ""
+	}
+	r = &TimeRange{}
+	var ok bool
+	if from != "" {
+		if r.From, _, ok = parseDuration(strings.TrimSpace(from)); !ok {
+			return nil, "Sorry, I don't understand the time in from; try something like 1:30 or 1m30s"
+		}
+	}
+	if to != "" {
+		if r.To, _, ok = parseDuration(strings.TrimSpace(to)); !ok {
+			return nil, "Sorry, I don't understand the time in to; try something like 2:00 or 2m"
+		}
+		if r.To <= r.From {
+			return nil, "The end should be after the start"
+		}
+	}
+	return r, ""
+}
+
+// interactionResponseData is the reply to an interaction with the same content as the message
+func interactionResponseData(message *discordgo.MessageSend) *discordgo.InteractionResponseData {
+	return &discordgo.InteractionResponseData{
+		Content:         message.Content,
+		Components:      message.Components,
+		Embeds:          message.Embeds,
+		Files:           message.Files,
+		TTS:             message.TTS,
+		AllowedMentions: message.AllowedMentions,
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/Mihonarium/discordgo"
+	"testing"
+)
+
+func TestRecognizeCommandTime(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		options  []*discordgo.ApplicationCommandInteractionDataOption
+		skip     string
+		reversed string
+	}{
+		{
+			name: "the time in the link",
+			url:  "https://example.com/clip.mp4?t=90",
+			skip: "90", reversed: "false",
+		},
+		{
+			name: "from instead of the time in the link",
+			url:  "https://example.com/clip.mp4?t=90",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "from", Type: discordgo.ApplicationCommandOptionString, Value: "0:10"},
+			},
+			skip: "10", reversed: "false",
+		},
+		{
+			name: "from 0 instead of the time in the link",
+			url:  "https://example.com/clip.mp4#t=90",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "from", Type: discordgo.ApplicationCommandOptionString, Value: "0"},
+			},
+			skip: "0", reversed: "false",
+		},
+		{
+			name: "from and to",
+			url:  "https://example.com/clip.mp4?t=90",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "from", Type: discordgo.ApplicationCommandOptionString, Value: "2:10"},
+				{Name: "to", Type: discordgo.ApplicationCommandOptionString, Value: "3:10"},
+			},
+			skip: "148", reversed: "false",
+		},
+		{
+			name: "at the end instead of the time in the link",
+			url:  "https://example.com/clip.mp4?t=1m30s",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "at_the_end", Type: discordgo.ApplicationCommandOptionBoolean, Value: true},
+			},
+			skip: "0", reversed: "true",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, recognizer := newTestBot()
+			options := append([]*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "url", Type: discordgo.ApplicationCommandOptionString, Value: tt.url},
+			}, tt.options...)
+			c.interactionCreate(s, testInteraction(discordgo.ApplicationCommandInteractionData{
+				Name:    "recognize",
+				Options: options,
+			}))
+			if len(recognizer.Requests) != 1 {
+				t.Fatalf("expected one request, got %+v", recognizer.Requests)
+			}
+			parameters := recognizer.Requests[0].Parameters
+			if parameters["skip_first_seconds"] != tt.skip || parameters["reversed_order"] != tt.reversed {
+				t.Errorf("got the parameters %v, want skip %s, reversed %s", parameters, tt.skip, tt.reversed)
+			}
+		})
+	}
+}
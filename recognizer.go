@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/AudDMusic/audd-go"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Recognizer identifies music in long audio files. *audd.Client implements it
+type Recognizer interface {
+	// RecognizeLongAudio accepts files as io.Reader or []byte and file URLs as string
+	RecognizeLongAudio(v interface{}, parameters map[string]string) ([]audd.RecognitionEnterpriseResult, error)
+}
+
+func newRecognizer(cfg *BotConfig) (Recognizer, error) {
+	switch cfg.RecognizerBackend {
+	case "", "audd":
+		client := audd.NewClient(cfg.AudDToken)
+		client.SetEndpoint(audd.EnterpriseAPIEndpoint)
+		return client, nil
+	case "fake":
+		return NewFakeRecognizer(cfg.FakeRecognizerFixtures)
+	}
+	return nil, fmt.Errorf("unknown recognizer backend %s", cfg.RecognizerBackend)
+}
+
+// RecognitionFixture is a response the fake recognizer returns for the URLs containing Match.
+// An empty Match matches anything, including files and recordings from voice channels
+type RecognitionFixture struct {
+	Match  string                             `json:"match"`
+	Result []audd.RecognitionEnterpriseResult `json:"result"`
+	Error  *audd.Error                        `json:"error"`
+}
+
+// FakeRecognizer returns results from fixtures instead of calling the API, so the bot can be run offline
+type FakeRecognizer struct {
+	Fixtures []RecognitionFixture
+	// Requests keeps the URLs (or "file" for files) and the parameters of the received requests
+	Requests []FakeRecognitionRequest
+	mu       sync.Mutex
+}
+
+type FakeRecognitionRequest struct {
+	Source     string
+	Parameters map[string]string
+}
+
+func NewFakeRecognizer(fixturesFile string) (*FakeRecognizer, error) {
+	j, err := os.ReadFile(fixturesFile)
+	if err != nil {
+		return nil, err
+	}
+	r := &FakeRecognizer{}
+	if err := json.Unmarshal(j, &r.Fixtures); err != nil {
+		return nil, fmt.Errorf("can't parse the fixtures from %s: %v", fixturesFile, err)
+	}
+	return r, nil
+}
+
+// RecognizeLongAudio returns the first fixture matching the URL; the fixtures are checked in order
+func (r *FakeRecognizer) RecognizeLongAudio(v interface{}, parameters map[string]string) ([]audd.RecognitionEnterpriseResult, error) {
+	source := "file"
+	if u, isURL := v.(string); isURL {
+		source = u
+	}
+	r.mu.Lock()
+	r.Requests = append(r.Requests, FakeRecognitionRequest{Source: source, Parameters: parameters})
+	r.mu.Unlock()
+	for _, fixture := range r.Fixtures {
+		if fixture.Match != "" && !strings.Contains(source, fixture.Match) {
+			continue
+		}
+		if fixture.Error != nil {
+			return nil, fixture.Error
+		}
+		return fixture.Result, nil
+	}
+	return nil, nil
+}
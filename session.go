@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Mihonarium/discordgo"
+)
+
+// Session is the part of *discordgo.Session the handlers use, so they can be run with FakeSession without a gateway
+type Session interface {
+	ChannelMessage(channelID, messageID string) (*discordgo.Message, error)
+	ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string) ([]*discordgo.Message, error)
+	ChannelMessageSend(channelID string, content string) (*discordgo.Message, error)
+	ChannelMessageSendReply(channelID string, content string, reference *discordgo.MessageReference) (*discordgo.Message, error)
+	ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend) (*discordgo.Message, error)
+	ChannelMessageCrosspost(channelID, messageID string) (*discordgo.Message, error)
+	ChannelMessageEditComplex(m *discordgo.MessageEdit) (*discordgo.Message, error)
+	MessageReactionAdd(channelID, messageID, emojiID string) error
+	MessageReactionRemove(channelID, messageID, emojiID, userID string) error
+	InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse) error
+	InteractionResponseEdit(appID string, interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit) (*discordgo.Message, error)
+	InteractionResponseDelete(appID string, interaction *discordgo.Interaction) error
+	FollowupMessageCreate(appID string, interaction *discordgo.Interaction, wait bool, data *discordgo.WebhookParams) (*discordgo.Message, error)
+	ChannelVoiceJoin(gID, cID string, mute, deaf bool, h *discordgo.VoiceSpeakingUpdateHandler) (*discordgo.VoiceConnection, error)
+	Channel(channelID string) (*discordgo.Channel, error)
+	// MessageSnapshots returns the copies of the messages forwarded with the message
+	MessageSnapshots(channelID, messageID string) ([]*discordgo.Message, error)
+
+	// StateGuild and StateChannel read from the state cache rather than the API
+	StateGuild(guildID string) (*discordgo.Guild, error)
+	StateChannel(channelID string) (*discordgo.Channel, error)
+	BotUserID() string
+}
+
+// discordSession adds the state accessors to *discordgo.Session
+type discordSession struct {
+	*discordgo.Session
+}
+
+var _ Session = discordSession{}
+
+func (s discordSession) StateGuild(guildID string) (*discordgo.Guild, error) {
+	return s.State.Guild(guildID)
+}
+
+func (s discordSession) StateChannel(channelID string) (*discordgo.Channel, error) {
+	return s.State.Channel(channelID)
+}
+
+func (s discordSession) BotUserID() string {
+	return s.State.User.ID
+}
+
+// MessageSnapshots requests the message again, since discordgo doesn't parse the snapshots
+func (s discordSession) MessageSnapshots(channelID, messageID string) ([]*discordgo.Message, error) {
+	response, err := s.RequestWithBucketID("GET", discordgo.EndpointChannelMessage(channelID, messageID), nil,
+		discordgo.EndpointChannelMessage(channelID, ""))
+	if err != nil {
+		return nil, err
+	}
+	var m struct {
+		MessageSnapshots []struct {
+			Message *discordgo.Message `json:"message"`
+		} `json:"message_snapshots"`
+	}
+	if err := json.Unmarshal(response, &m); err != nil {
+		return nil, err
+	}
+	snapshots := make([]*discordgo.Message, 0, len(m.MessageSnapshots))
+	for _, snapshot := range m.MessageSnapshots {
+		if snapshot.Message != nil {
+			snapshots = append(snapshots, snapshot.Message)
+		}
+	}
+	return snapshots, nil
+}
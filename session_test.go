@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Mihonarium/discordgo"
+	"sort"
+	"sync"
+	"time"
+)
+
+var _ Session = (*FakeSession)(nil)
+
+type FakeSentMessage struct {
+	ChannelID string
+	Message   *discordgo.MessageSend
+}
+
+type FakeReaction struct {
+	ChannelID string
+	MessageID string
+	Emoji     string
+	Removed   bool
+}
+
+type FakeInteractionResponse struct {
+	Interaction *discordgo.Interaction
+	Response    *discordgo.InteractionResponse
+}
+
+type FakeInteractionEdit struct {
+	Interaction *discordgo.Interaction
+	Edit        *discordgo.WebhookEdit
+}
+
+type FakeFollowup struct {
+	Interaction *discordgo.Interaction
+	Params      *discordgo.WebhookParams
+}
+
+// FakeSession is an in-memory Session. It serves messages, guilds and channels from its maps and
+// records everything the bot sends
+type FakeSession struct {
+	UserID string
+	// Messages are keyed by channel ID and message ID joined with a slash
+	Messages map[string]*discordgo.Message
+	Guilds   map[string]*discordgo.Guild
+	Channels map[string]*discordgo.Channel
+	// Snapshots are the forwarded messages, keyed like Messages
+	Snapshots map[string][]*discordgo.Message
+
+	Sent                 []FakeSentMessage
+	Reactions            []FakeReaction
+	InteractionResponses []FakeInteractionResponse
+	InteractionEdits     []FakeInteractionEdit
+	// DeletedResponses are the interactions whose responses were deleted
+	DeletedResponses []*discordgo.Interaction
+	// Edits are the message edits; the edited messages in Messages are updated as well
+	Edits     []*discordgo.MessageEdit
+	Followups []FakeFollowup
+
+	mu     sync.Mutex
+	lastID int
+}
+
+func NewFakeSession(botUserID string) *FakeSession {
+	return &FakeSession{
+		UserID:    botUserID,
+		Messages:  map[string]*discordgo.Message{},
+		Guilds:    map[string]*discordgo.Guild{},
+		Channels:  map[string]*discordgo.Channel{},
+		Snapshots: map[string][]*discordgo.Message{},
+	}
+}
+
+// AddMessage makes the message available to ChannelMessage
+func (s *FakeSession) AddMessage(m *discordgo.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Messages[m.ChannelID+"/"+m.ID] = m
+}
+
+func (s *FakeSession) ChannelMessage(channelID, messageID string) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, exists := s.Messages[channelID+"/"+messageID]
+	if !exists {
+		return nil, fmt.Errorf("fake session: unknown message %s in channel %s", messageID, channelID)
+	}
+	return m, nil
+}
+
+// ChannelMessages returns the channel's messages from the newest; only beforeID is supported
+func (s *FakeSession) ChannelMessages(channelID string, limit int, beforeID, _, _ string) ([]*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var before time.Time
+	if m, exists := s.Messages[channelID+"/"+beforeID]; exists {
+		before = m.Timestamp
+	}
+	messages := make([]*discordgo.Message, 0)
+	for _, m := range s.Messages {
+		if m.ChannelID != channelID || m.ID == beforeID || (!before.IsZero() && !m.Timestamp.Before(before)) {
+			continue
+		}
+		messages = append(messages, m)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Timestamp.After(messages[j].Timestamp)
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (s *FakeSession) ChannelMessageSend(channelID string, content string) (*discordgo.Message, error) {
+	return s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{Content: content})
+}
+
+func (s *FakeSession) ChannelMessageSendReply(channelID string, content string, reference *discordgo.MessageReference) (*discordgo.Message, error) {
+	return s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{Content: content, Reference: reference})
+}
+
+func (s *FakeSession) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Sent = append(s.Sent, FakeSentMessage{ChannelID: channelID, Message: data})
+	return s.newMessage(channelID, data.Content), nil
+}
+
+func (s *FakeSession) ChannelMessageCrosspost(channelID, messageID string) (*discordgo.Message, error) {
+	return s.ChannelMessage(channelID, messageID)
+}
+
+func (s *FakeSession) ChannelMessageEditComplex(edit *discordgo.MessageEdit) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Edits = append(s.Edits, edit)
+	m, exists := s.Messages[edit.Channel+"/"+edit.ID]
+	if !exists {
+		return nil, fmt.Errorf("fake session: unknown message %s in channel %s", edit.ID, edit.Channel)
+	}
+	if edit.Content != nil {
+		m.Content = *edit.Content
+	}
+	if edit.Embeds != nil {
+		m.Embeds = edit.Embeds
+	}
+	return m, nil
+}
+
+func (s *FakeSession) MessageReactionAdd(channelID, messageID, emojiID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Reactions = append(s.Reactions, FakeReaction{ChannelID: channelID, MessageID: messageID, Emoji: emojiID})
+	return nil
+}
+
+func (s *FakeSession) MessageReactionRemove(channelID, messageID, emojiID, _ string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Reactions = append(s.Reactions, FakeReaction{ChannelID: channelID, MessageID: messageID, Emoji: emojiID, Removed: true})
+	return nil
+}
+
+func (s *FakeSession) InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.InteractionResponses = append(s.InteractionResponses, FakeInteractionResponse{Interaction: interaction, Response: resp})
+	return nil
+}
+
+func (s *FakeSession) InteractionResponseEdit(_ string, interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.InteractionEdits = append(s.InteractionEdits, FakeInteractionEdit{Interaction: interaction, Edit: newresp})
+	return &discordgo.Message{ChannelID: interaction.ChannelID, Content: newresp.Content, Embeds: newresp.Embeds}, nil
+}
+
+func (s *FakeSession) InteractionResponseDelete(_ string, interaction *discordgo.Interaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DeletedResponses = append(s.DeletedResponses, interaction)
+	return nil
+}
+
+func (s *FakeSession) FollowupMessageCreate(_ string, interaction *discordgo.Interaction, _ bool, data *discordgo.WebhookParams) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Followups = append(s.Followups, FakeFollowup{Interaction: interaction, Params: data})
+	return s.newMessage(interaction.ChannelID, data.Content), nil
+}
+
+func (s *FakeSession) ChannelVoiceJoin(_, _ string, _, _ bool, _ *discordgo.VoiceSpeakingUpdateHandler) (*discordgo.VoiceConnection, error) {
+	return nil, fmt.Errorf("fake session: voice channels aren't supported")
+}
+
+func (s *FakeSession) StateGuild(guildID string) (*discordgo.Guild, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, exists := s.Guilds[guildID]
+	if !exists {
+		return nil, discordgo.ErrStateNotFound
+	}
+	return g, nil
+}
+
+func (s *FakeSession) StateChannel(channelID string) (*discordgo.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch, exists := s.Channels[channelID]
+	if !exists {
+		return nil, discordgo.ErrStateNotFound
+	}
+	return ch, nil
+}
+
+func (s *FakeSession) Channel(channelID string) (*discordgo.Channel, error) {
+	ch, err := s.StateChannel(channelID)
+	if err != nil {
+		return nil, fmt.Errorf("fake session: unknown channel %s", channelID)
+	}
+	return ch, nil
+}
+
+func (s *FakeSession) MessageSnapshots(channelID, messageID string) ([]*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Snapshots[channelID+"/"+messageID], nil
+}
+
+func (s *FakeSession) BotUserID() string {
+	return s.UserID
+}
+
+// newMessage stores a message sent by the bot; s.mu must be held
+func (s *FakeSession) newMessage(channelID, content string) *discordgo.Message {
+	s.lastID++
+	m := &discordgo.Message{
+		ID:        fmt.Sprintf("fake-%d", s.lastID),
+		ChannelID: channelID,
+		Content:   content,
+		Author:    &discordgo.User{ID: s.UserID, Bot: true},
+		Timestamp: time.Now(),
+	}
+	s.Messages[channelID+"/"+m.ID] = m
+	return m
+}
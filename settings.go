@@ -0,0 +1,620 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Mihonarium/discordgo"
+	bolt "go.etcd.io/bbolt"
+	"strings"
+	"sync"
+)
+
+var guildSettingsBucket = []byte("guild-settings")
+
+// GuildSettings overrides the global config for a single server; nil values mean the global value is used
+type GuildSettings struct {
+	MinScore                *int          `json:"min_score,omitempty"`
+	Triggers                []TriggerRule `json:"triggers"`
+	AntiTriggers            []TriggerRule `json:"anti_triggers"`
+	UncompressedLimit       *int          `json:"uncompressed_limit,omitempty"`
+	CompressStartingWith    *int          `json:"compress_starting_with,omitempty"`
+	CanCompressWithoutSlash *bool         `json:"can_compress_without_slash,omitempty"`
+	MaxReplyDepth           *int          `json:"max_reply_depth,omitempty"`
+	RecordSeconds           *int          `json:"record_seconds,omitempty"`
+	RecognizeAllLinks       *bool         `json:"recognize_all_links,omitempty"`
+	MaxMixMinutes           *int          `json:"max_mix_minutes,omitempty"`
+	PrivateResults          *bool         `json:"private_results,omitempty"`
+
+	UserRateLimit    *RateLimit `json:"user_rate_limit,omitempty"`
+	ChannelRateLimit *RateLimit `json:"channel_rate_limit,omitempty"`
+	GuildRateLimit   *RateLimit `json:"guild_rate_limit,omitempty"`
+}
+
+type SettingsStore struct {
+	db    *bolt.DB
+	cache map[string]GuildSettings
+	mu    sync.Mutex
+}
+
+var Settings *SettingsStore
+
+func NewSettingsStore(db *bolt.DB) *SettingsStore {
+	return &SettingsStore{db: db, cache: map[string]GuildSettings{}}
+}
+
+func (st *SettingsStore) Get(guildID string) (GuildSettings, error) {
+	var settings GuildSettings
+	if st == nil || guildID == "" {
+		return settings, nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if cached, ok := st.cache[guildID]; ok {
+		return cached, nil
+	}
+	err := st.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(guildSettingsBucket).Get([]byte(guildID))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &settings)
+	})
+	if err != nil {
+		return settings, err
+	}
+	st.cache[guildID] = settings
+	return settings, nil
+}
+
+// Update applies f to the server's stored settings and saves the result. The settings can't change in between,
+// so f should make the changes from the settings it gets rather than from a config read before
+func (st *SettingsStore) Update(guildID string, f func(settings *GuildSettings)) error {
+	if st == nil {
+		return fmt.Errorf("the settings storage isn't open")
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var settings GuildSettings
+	// The settings are decoded from the database, so f can't modify the cached slices
+	err := st.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(guildSettingsBucket)
+		if v := b.Get([]byte(guildID)); v != nil {
+			if err := json.Unmarshal(v, &settings); err != nil {
+				return err
+			}
+		}
+		f(&settings)
+		v, err := json.Marshal(settings)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(guildID), v)
+	})
+	if err != nil {
+		delete(st.cache, guildID)
+		return err
+	}
+	st.cache[guildID] = settings
+	return nil
+}
+
+// globalConfig returns the config without the server's overrides
+func (c *BotConfig) globalConfig() *BotConfig {
+	if c.defaults != nil {
+		return c.defaults
+	}
+	return c
+}
+
+// ForGuild returns a copy of the config with the server's overrides applied
+func (c *BotConfig) ForGuild(guildID string) *BotConfig {
+	settings, err := Settings.Get(guildID)
+	if capture(err) {
+		return c
+	}
+	cfg := *c
+	cfg.defaults = c
+	if settings.MinScore != nil {
+		cfg.MinScore = *settings.MinScore
+	}
+	if settings.Triggers != nil {
+		cfg.Triggers = settings.Triggers
+	}
+	if settings.AntiTriggers != nil {
+		cfg.AntiTriggers = settings.AntiTriggers
+	}
+	if settings.UncompressedLimit != nil {
+		cfg.UncompressedLimit = *settings.UncompressedLimit
+	}
+	if settings.CompressStartingWith != nil {
+		cfg.CompressStartingWith = *settings.CompressStartingWith
+	}
+	if settings.CanCompressWithoutSlash != nil {
+		cfg.CanCompressWithoutSlash = *settings.CanCompressWithoutSlash
+	}
+	if settings.MaxReplyDepth != nil {
+		cfg.MaxReplyDepth = *settings.MaxReplyDepth
+	}
+	if settings.RecordSeconds != nil {
+		cfg.RecordSeconds = *settings.RecordSeconds
+	}
+	if settings.RecognizeAllLinks != nil {
+		cfg.RecognizeAllLinks = *settings.RecognizeAllLinks
+	}
+	if settings.PrivateResults != nil {
+		cfg.PrivateResults = *settings.PrivateResults
+	}
+	// Servers can only scan shorter mixes than the global limit
+	if settings.MaxMixMinutes != nil && *settings.MaxMixMinutes < c.MaxMixMinutes {
+		cfg.MaxMixMinutes = *settings.MaxMixMinutes
+	}
+	if settings.UserRateLimit != nil {
+		cfg.UserRateLimit = settings.UserRateLimit.within(c.UserRateLimit)
+	}
+	if settings.ChannelRateLimit != nil {
+		cfg.ChannelRateLimit = settings.ChannelRateLimit.within(c.ChannelRateLimit)
+	}
+	if settings.GuildRateLimit != nil {
+		cfg.GuildRateLimit = settings.GuildRateLimit.within(c.GuildRateLimit)
+	}
+	return &cfg
+}
+
+var settingsCommand = &discordgo.ApplicationCommand{
+	Type:        discordgo.ChatApplicationCommand,
+	Name:        "settings",
+	Description: "Change how the bot works on this server (requires the Manage Server permission)",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "view",
+			Description: "Show the current settings",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "set-min-score",
+			Description: "Set the minimum matched score for a song to be shown",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "score",
+				Description: "The minimum score, from 0 to 100",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "add-trigger",
+			Description: "Add a phrase the bot will react to",
+			Options:     triggerOptions("The phrase, e.g., !song"),
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "remove-trigger",
+			Description: "Remove a phrase the bot reacts to",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "phrase",
+				Description: "The phrase to remove",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "add-anti-trigger",
+			Description: "Add a phrase that stops the bot from reacting to a message",
+			Options:     triggerOptions("The phrase, e.g., whats the song about"),
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "remove-anti-trigger",
+			Description: "Remove a phrase that stops the bot from reacting to a message",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "phrase",
+				Description: "The phrase to remove",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "set-record-seconds",
+			Description: "Set how many seconds of audio to record from voice channels",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "seconds",
+				Description: fmt.Sprintf("The number of seconds, from %d to %d", MinRecordSeconds, MaxRecordSeconds),
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "set-result-style",
+			Description: "Choose how the recognized songs are shown",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "style",
+				Description: "The result style",
+				Required:    true,
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "Default", Value: "default"},
+					{Name: "Always large embeds", Value: "large"},
+					{Name: "Always small embeds", Value: "small"},
+					{Name: "Compact text", Value: "compact"},
+				},
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "set-all-links",
+			Description: "Choose whether to recognize every link from a message or only the first one",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "enabled",
+				Description: "Whether to recognize every link",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "set-private-results",
+			Description: "Choose whether the results of slash commands are only shown to the person who asked",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "enabled",
+				Description: "Whether to show the results privately unless the private option says otherwise",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "set-max-mix-minutes",
+			Description: "Set how many minutes of a file /recognize-mix and !song full scan",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "minutes",
+				Description: "The number of minutes",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "set-rate-limit",
+			Description: "Limit how often the bot can be asked to recognize songs",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "scope",
+					Description: "What the limit applies to",
+					Required:    true,
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "Each user", Value: "user"},
+						{Name: "Each channel", Value: "channel"},
+						{Name: "The whole server", Value: "server"},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "per-minute",
+					Description: "How many requests are allowed per minute; 0 for no limit",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "burst",
+					Description: "How many requests can be made at once",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "daily",
+					Description: "How many requests are allowed per day; 0 for no limit",
+				},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "reset",
+			Description: "Reset all the settings to the defaults",
+		},
+	},
+}
+
+func (c *BotConfig) SettingsCommand(s Session, i *discordgo.InteractionCreate) {
+	respond := func(content string) {
+		capture(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content:         content,
+				AllowedMentions: &discordgo.MessageAllowedMentions{},
+				Flags:           1 << 6,
+			},
+		}))
+	}
+	if i.GuildID == "" || i.Member == nil {
+		respond("Sorry, the settings can only be changed on servers")
+		return
+	}
+	if i.Member.Permissions&(discordgo.PermissionManageServer|discordgo.PermissionAdministrator) == 0 {
+		respond("Sorry, only members with the Manage Server permission can change the settings")
+		return
+	}
+	data := i.ApplicationCommandData()
+	if len(data.Options) == 0 {
+		return
+	}
+	subcommand := data.Options[0]
+	options := map[string]*discordgo.ApplicationCommandInteractionDataOption{}
+	for _, option := range subcommand.Options {
+		options[option.Name] = option
+	}
+	var response string
+	var err error
+	switch subcommand.Name {
+	case "view":
+		respond(c.settingsDescription(i.GuildID))
+		return
+	case "set-min-score":
+		score := int(options["score"].IntValue())
+		if score < 0 || score > 100 {
+			respond("The score should be from 0 to 100")
+			return
+		}
+		err = Settings.Update(i.GuildID, func(settings *GuildSettings) {
+			settings.MinScore = &score
+		})
+		response = fmt.Sprintf("I'll only show songs matched with at least %d%%", score)
+	case "add-trigger", "add-anti-trigger":
+		anti := subcommand.Name == "add-anti-trigger"
+		phrase := options["phrase"].StringValue()
+		rule := TriggerRule{Pattern: normalizeTrigger(phrase)}
+		if o, ok := options["regex"]; ok && o.BoolValue() {
+			// Regular expressions are matched case-insensitively, so they're only trimmed
+			rule.Regex, rule.Pattern = true, strings.TrimSpace(phrase)
+		}
+		if o, ok := options["whole-words"]; ok {
+			rule.WordBoundary = o.BoolValue()
+		}
+		if rule.Pattern == "" {
+			respond("The phrase can't be empty")
+			return
+		}
+		if e := rule.compile(); e != nil {
+			respond(fmt.Sprintf("Sorry, that's not a valid regular expression: %v", e))
+			return
+		}
+		response = fmt.Sprintf("I'll react to messages with %s", rule)
+		if anti {
+			response = fmt.Sprintf("I won't react to messages with %s", rule)
+		}
+		err = Settings.Update(i.GuildID, func(settings *GuildSettings) {
+			current := settings.triggers(anti, c.globalConfig())
+			rules := append(make([]TriggerRule, 0, len(current)+1), current...)
+			if index := triggerIndex(rules, rule.Pattern); index >= 0 {
+				rules[index] = rule
+			} else {
+				rules = append(rules, rule)
+			}
+			settings.setTriggers(anti, rules)
+		})
+	case "remove-trigger", "remove-anti-trigger":
+		anti := subcommand.Name == "remove-anti-trigger"
+		list := "phrases I react to"
+		if anti {
+			list = "anti-triggers"
+		}
+		phrase := options["phrase"].StringValue()
+		var pattern string
+		found := false
+		err = Settings.Update(i.GuildID, func(settings *GuildSettings) {
+			current := settings.triggers(anti, c.globalConfig())
+			// Regular expressions are saved as they were typed and phrases are normalized
+			pattern = strings.TrimSpace(phrase)
+			if triggerIndex(current, pattern) < 0 {
+				pattern = normalizeTrigger(phrase)
+			}
+			if triggerIndex(current, pattern) < 0 {
+				return
+			}
+			found = true
+			rules := make([]TriggerRule, 0, len(current))
+			for _, rule := range current {
+				if rule.Pattern != pattern {
+					rules = append(rules, rule)
+				}
+			}
+			settings.setTriggers(anti, rules)
+		})
+		response = fmt.Sprintf("Removed `%s` from the %s", pattern, list)
+		if !found {
+			response = fmt.Sprintf("`%s` isn't one of the %s", pattern, list)
+		}
+	case "set-record-seconds":
+		seconds := int(options["seconds"].IntValue())
+		if seconds < MinRecordSeconds || seconds > MaxRecordSeconds {
+			respond(fmt.Sprintf("The number of seconds should be from %d to %d", MinRecordSeconds, MaxRecordSeconds))
+			return
+		}
+		err = Settings.Update(i.GuildID, func(settings *GuildSettings) {
+			settings.RecordSeconds = &seconds
+		})
+		response = fmt.Sprintf("I'll record %d seconds of audio from voice channels", seconds)
+	case "set-result-style":
+		style := options["style"].StringValue()
+		err = Settings.Update(i.GuildID, func(settings *GuildSettings) {
+			settings.UncompressedLimit, settings.CompressStartingWith, settings.CanCompressWithoutSlash = nil, nil, nil
+			zero, noLimit, yes, no := 0, -1, true, false
+			switch style {
+			case "large":
+				settings.UncompressedLimit = &noLimit
+			case "small":
+				settings.UncompressedLimit, settings.CompressStartingWith, settings.CanCompressWithoutSlash = &zero, &zero, &no
+			case "compact":
+				settings.UncompressedLimit, settings.CanCompressWithoutSlash = &zero, &yes
+			}
+		})
+		response = "Updated the result style"
+	case "set-all-links":
+		enabled := options["enabled"].BoolValue()
+		err = Settings.Update(i.GuildID, func(settings *GuildSettings) {
+			settings.RecognizeAllLinks = &enabled
+		})
+		response = "I'll only recognize the first link from a message"
+		if enabled {
+			response = fmt.Sprintf("I'll recognize up to %d links from a message", c.MaxLinksPerMessage)
+		}
+	case "set-private-results":
+		enabled := options["enabled"].BoolValue()
+		err = Settings.Update(i.GuildID, func(settings *GuildSettings) {
+			settings.PrivateResults = &enabled
+		})
+		response = "I'll show the results of /song-vc, /recognize and Recognize This Song to everyone"
+		if enabled {
+			response = "I'll only show the results of /song-vc, /recognize and Recognize This Song to the person who asked"
+		}
+	case "set-max-mix-minutes":
+		minutes := int(options["minutes"].IntValue())
+		if maxMinutes := c.globalConfig().MaxMixMinutes; minutes < 1 || minutes > maxMinutes {
+			respond(fmt.Sprintf("The number of minutes should be from 1 to %d", maxMinutes))
+			return
+		}
+		err = Settings.Update(i.GuildID, func(settings *GuildSettings) {
+			settings.MaxMixMinutes = &minutes
+		})
+		response = fmt.Sprintf("I'll scan up to %d minutes of mixes", minutes)
+	case "set-rate-limit":
+		scope := options["scope"].StringValue()
+		for _, name := range []string{"per-minute", "burst", "daily"} {
+			if o, ok := options[name]; ok && o.IntValue() < 0 {
+				respond("The limits can't be negative")
+				return
+			}
+		}
+		defaults := c.globalConfig()
+		var limit RateLimit
+		err = Settings.Update(i.GuildID, func(settings *GuildSettings) {
+			stored := map[string]**RateLimit{"user": &settings.UserRateLimit, "channel": &settings.ChannelRateLimit,
+				"server": &settings.GuildRateLimit}[scope]
+			limit = *defaults.rateLimits()[scope]
+			if *stored != nil {
+				limit = **stored
+			}
+			if o, ok := options["per-minute"]; ok {
+				limit.PerMinute = float64(o.IntValue())
+			}
+			if o, ok := options["burst"]; ok {
+				limit.Burst = int(o.IntValue())
+			}
+			if o, ok := options["daily"]; ok {
+				limit.Daily = int(o.IntValue())
+			}
+			saved := limit
+			*stored = &saved
+		})
+		response = fmt.Sprintf("The limit is now %s", limit.within(*defaults.rateLimits()[scope]))
+	case "reset":
+		err = Settings.Update(i.GuildID, func(settings *GuildSettings) {
+			*settings = GuildSettings{}
+		})
+		response = "All the settings are reset to the defaults"
+	default:
+		fmt.Println("Unknown settings subcommand:", subcommand.Name)
+		return
+	}
+	if capture(err) {
+		respond("Sorry, I couldn't save the settings")
+		return
+	}
+	respond(response)
+}
+
+func (c *BotConfig) settingsDescription(guildID string) string {
+	settings, err := Settings.Get(guildID)
+	if capture(err) {
+		return "Sorry, I couldn't read the settings"
+	}
+	overridden := func(isSet bool) string {
+		if isSet {
+			return ""
+		}
+		return " (default)"
+	}
+	triggers := make([]string, 0, len(c.Triggers))
+	for _, t := range c.Triggers {
+		triggers = append(triggers, t.String())
+	}
+	antiTriggers := make([]string, 0, len(c.AntiTriggers))
+	for _, t := range c.AntiTriggers {
+		antiTriggers = append(antiTriggers, t.String())
+	}
+	return fmt.Sprintf("**Minimum score:** %d%%%s\n"+
+		"**Triggers:** %s%s\n"+
+		"**Anti-triggers:** %s%s\n"+
+		"**Max reply depth:** %d%s\n"+
+		"**Voice recording length:** %d seconds%s\n"+
+		"**Recognize every link from a message:** %t%s\n"+
+		"**Max mix length:** %d minutes%s\n"+
+		"**Private results:** %t%s\n"+
+		"**Result style:** uncompressed limit %d, compress starting with %d, can compress without a slash command: %t%s\n"+
+		"**Rate limit per user:** %s%s\n"+
+		"**Rate limit per channel:** %s%s\n"+
+		"**Rate limit for the server:** %s%s",
+		c.MinScore, overridden(settings.MinScore != nil),
+		strings.Join(triggers, ", "), overridden(settings.Triggers != nil),
+		strings.Join(antiTriggers, ", "), overridden(settings.AntiTriggers != nil),
+		c.MaxReplyDepth, overridden(settings.MaxReplyDepth != nil),
+		c.RecordSeconds, overridden(settings.RecordSeconds != nil),
+		c.RecognizeAllLinks, overridden(settings.RecognizeAllLinks != nil),
+		c.MaxMixMinutes, overridden(settings.MaxMixMinutes != nil),
+		c.PrivateResults, overridden(settings.PrivateResults != nil),
+		c.UncompressedLimit, c.CompressStartingWith, c.CanCompressWithoutSlash,
+		overridden(settings.UncompressedLimit != nil || settings.CanCompressWithoutSlash != nil),
+		c.UserRateLimit, overridden(settings.UserRateLimit != nil),
+		c.ChannelRateLimit, overridden(settings.ChannelRateLimit != nil),
+		c.GuildRateLimit, overridden(settings.GuildRateLimit != nil))
+}
+
+// triggers returns the server's triggers or anti-triggers, or the global ones if the server doesn't change them
+func (settings *GuildSettings) triggers(anti bool, defaults *BotConfig) []TriggerRule {
+	if anti {
+		if settings.AntiTriggers != nil {
+			return settings.AntiTriggers
+		}
+		return defaults.AntiTriggers
+	}
+	if settings.Triggers != nil {
+		return settings.Triggers
+	}
+	return defaults.Triggers
+}
+
+func (settings *GuildSettings) setTriggers(anti bool, rules []TriggerRule) {
+	if anti {
+		settings.AntiTriggers = rules
+	} else {
+		settings.Triggers = rules
+	}
+}
+
+func triggerOptions(phraseDescription string) []*discordgo.ApplicationCommandOption {
+	return []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "phrase",
+			Description: phraseDescription,
+			Required:    true,
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionBoolean,
+			Name:        "regex",
+			Description: "Whether the phrase is a regular expression",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionBoolean,
+			Name:        "whole-words",
+			Description: "Only match whole words, so !song doesn't match !songs",
+		},
+	}
+}
+
+// normalizeTrigger converts a phrase the same way getBodyToCompare converts messages
+func normalizeTrigger(trigger string) string {
+	return strings.TrimSpace(strings.ReplaceAll(strings.ToLower(replaceSlice(trigger, "", "'", "’", "`")), "what is", "whats"))
+}
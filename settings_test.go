@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSettingsConcurrentUpdates(t *testing.T) {
+	st := NewSettingsStore(openTestDatabase(t, filepath.Join(t.TempDir(), "settings.db")))
+	defaults := &BotConfig{Triggers: []TriggerRule{{Pattern: "!song"}}}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := st.Update(testGuildID, func(settings *GuildSettings) {
+				settings.setTriggers(false, append(settings.triggers(false, defaults), TriggerRule{Pattern: fmt.Sprint(i)}))
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	settings, err := st.Get(testGuildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(settings.Triggers) != 21 {
+		t.Fatalf("got %d triggers, want the default and 20 added ones", len(settings.Triggers))
+	}
+	for i := 0; i < 20; i++ {
+		if triggerIndex(settings.Triggers, fmt.Sprint(i)) < 0 {
+			t.Errorf("the trigger %d was lost", i)
+		}
+	}
+	if settings.Triggers[0].Pattern != "!song" {
+		t.Errorf("the default trigger wasn't kept")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TimeRange is the part of the audio someone asked about. To is 0 if only the start is known.
+// FromEnd means the end of the audio, and Last is how many seconds from the end, if specified
+type TimeRange struct {
+	From    int
+	To      int
+	FromEnd bool
+	Last    int
+}
+
+func (r TimeRange) IsZero() bool {
+	return r == TimeRange{}
+}
+
+// Longer times are typos, and they could overflow the sums
+const maxDuration = 24 * 60 * 60
+
+var (
+	isoDuration  = regexp.MustCompile(`^pt(?:(\d+)h)?(?:(\d+)m)?(?:(\d+)(?:\.\d+)?s)?$`)
+	unitDuration = regexp.MustCompile(`^(?:(\d+)h(?:ours?|rs?)?)?(?:(\d+)m(?:in(?:ute)?s?)?)?(?:(\d+)s(?:ec(?:ond)?s?)?)?$`)
+	timeUnits    = map[string]bool{
+		"h": true, "hr": true, "hrs": true, "hour": true, "hours": true,
+		"m": true, "min": true, "mins": true, "minute": true, "minutes": true,
+		"s": true, "sec": true, "secs": true, "second": true, "seconds": true,
+	}
+)
+
+// parseDuration parses 90, 1:30, 1:02:03, 1m30s, 1h2m3s, 90sec, 2min, and ISO 8601 durations like PT1M30S.
+// explicit is false for plain numbers, which are only times in some contexts. Times over 24 hours aren't accepted
+func parseDuration(s string) (seconds int, explicit bool, ok bool) {
+	s = strings.ToLower(s)
+	if s == "" {
+		return 0, false, false
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, false, n >= 0 && n <= maxDuration
+	}
+	if strings.Contains(s, ":") {
+		for _, part := range strings.Split(s, ":") {
+			if part == "" || strings.Trim(part, "0123456789") != "" {
+				return 0, false, false
+			}
+			if n, err := strconv.Atoi(part); err != nil || n > maxDuration {
+				return 0, false, false
+			}
+		}
+		n, err := TimeStringToSeconds(s)
+		return n, true, err == nil && n <= maxDuration
+	}
+	groups := isoDuration.FindStringSubmatch(s)
+	if groups == nil {
+		groups = unitDuration.FindStringSubmatch(s)
+	}
+	if groups == nil || groups[1]+groups[2]+groups[3] == "" {
+		return 0, false, false
+	}
+	for i, multiplier := range []int{3600, 60, 1} {
+		if groups[i+1] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(groups[i+1])
+		if err != nil || n > maxDuration {
+			return 0, false, false
+		}
+		seconds += n * multiplier
+	}
+	return seconds, true, seconds <= maxDuration
+}
+
+// unambiguousTime is whether the word is a time even without words like "at" around it:
+// "1:30" or "1m30s" are, but "90s" or "5m" might mean something else
+func unambiguousTime(word string) bool {
+	if strings.Contains(word, ":") || isoDuration.MatchString(word) {
+		return true
+	}
+	groups := unitDuration.FindStringSubmatch(word)
+	if groups == nil {
+		return false
+	}
+	units := 0
+	for _, group := range groups[1:] {
+		if group != "" {
+			units++
+		}
+	}
+	return units >= 2
+}
+
+// timeWords splits the text into lowercase words, joining numbers with the units after them, so "30 seconds" is one word
+func timeWords(text string) []string {
+	text = strings.ToLower(replaceSlice(text, "-", "–", "—"))
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ' ' || r == '\n' || r == '\t' || r == ',' || r == '?' || r == '(' || r == ')'
+	})
+	words := make([]string, 0, len(fields))
+	for i := 0; i < len(fields); i++ {
+		word := strings.TrimSuffix(fields[i], ".")
+		if i+1 < len(fields) && timeUnits[strings.TrimSuffix(fields[i+1], ".")] {
+			if _, err := strconv.Atoi(word); err == nil {
+				word += strings.TrimSuffix(fields[i+1], ".")
+				i++
+			}
+		}
+		// "2:10 - 2:40" is the same as "2:10-2:40"
+		if word == "-" && len(words) > 0 && i+1 < len(fields) {
+			words[len(words)-1] += "-" + strings.TrimSuffix(fields[i+1], ".")
+			i++
+			continue
+		}
+		words = append(words, word)
+	}
+	return words
+}
+
+// TimeRangeFromText finds the time in messages like "at 1m30s", "from 2:10 to 2:40", "1:00-1:30", "10-20",
+// "last 30 seconds", or "at the end". Other plain numbers and single units like "90s" are only considered times
+// after words like "at" or "from"
+func TimeRangeFromText(text string) TimeRange {
+	words := timeWords(text)
+	var best TimeRange
+	bestScore := 0
+	found := func(r TimeRange, score int) {
+		if score > bestScore {
+			best, bestScore = r, score
+		}
+	}
+	for i, word := range words {
+		next := func(offset int) string {
+			if i+offset < len(words) {
+				return words[i+offset]
+			}
+			return ""
+		}
+		switch word {
+		case "last", "final":
+			if last, _, ok := parseDuration(next(1)); ok && last > 0 {
+				found(TimeRange{FromEnd: true, Last: last}, 5)
+			}
+		case "end", "ending", "outro":
+			if i > 0 && (words[i-1] == "the" || words[i-1] == "at") {
+				found(TimeRange{FromEnd: true}, 1)
+			}
+		case "from", "between":
+			from, _, ok := parseDuration(next(1))
+			if !ok {
+				continue
+			}
+			separator := next(2)
+			if separator == "to" || separator == "and" || separator == "till" || separator == "until" {
+				if to, _, ok := parseDuration(next(3)); ok && to > from {
+					found(TimeRange{From: from, To: to}, 5)
+					continue
+				}
+			}
+			found(TimeRange{From: from}, 3)
+		case "at", "around", "@":
+			if at, _, ok := parseDuration(next(1)); ok {
+				found(TimeRange{From: at}, 3)
+			}
+		default:
+			if strings.Contains(word, "-") {
+				parts := strings.SplitN(word, "-", 2)
+				from, explicitFrom, ok := parseDuration(parts[0])
+				to, explicitTo, okTo := parseDuration(parts[1])
+				if ok && okTo && to > from {
+					// Ranges of plain numbers like 10-20 are less certain
+					if explicitFrom || explicitTo {
+						found(TimeRange{From: from, To: to}, 4)
+					} else {
+						found(TimeRange{From: from, To: to}, 1)
+					}
+				}
+				continue
+			}
+			if at, _, ok := parseDuration(word); ok && unambiguousTime(word) {
+				found(TimeRange{From: at}, 2)
+			}
+		}
+	}
+	return best
+}
+
+// TimeRangeFromLink finds the time in links with ?t=1h2m3s (YouTube, Twitch), time_continue, start,
+// and fragments like #t=90 or #t=90,120
+func TimeRangeFromLink(link string) TimeRange {
+	if strings.HasSuffix(link, ".m3u8") {
+		return TimeRange{}
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return TimeRange{}
+	}
+	query := u.Query()
+	for _, key := range []string{"t", "time_continue", "start"} {
+		if from, ok := linkDuration(query.Get(key)); ok && from > 0 {
+			return TimeRange{From: from}
+		}
+	}
+	fragment, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		return TimeRange{}
+	}
+	t := strings.SplitN(fragment.Get("t"), ",", 2)
+	from, ok := linkDuration(t[0])
+	if !ok {
+		return TimeRange{}
+	}
+	r := TimeRange{From: from}
+	if len(t) == 2 {
+		if to, ok := linkDuration(t[1]); ok && to > from {
+			r.To = to
+		}
+	}
+	return r
+}
+
+// requestedTimeRange is the time set explicitly, if any, or the time from the link, or, if the link doesn't have it,
+// from the message text
+func requestedTimeRange(link, text string, explicit *TimeRange) TimeRange {
+	if explicit != nil {
+		return *explicit
+	}
+	if r := TimeRangeFromLink(link); !r.IsZero() {
+		return r
+	}
+	return TimeRangeFromText(text)
+}
+
+// linkDuration parses the time in a link, where the last unit can be left out: 1m30 is 1m30s, and 1h30 is 1h30m
+func linkDuration(s string) (int, bool) {
+	if seconds, _, ok := parseDuration(s); ok {
+		return seconds, true
+	}
+	s = strings.ToLower(s)
+	unit := strings.LastIndexAny(s, "hm")
+	if unit < 0 || unit == len(s)-1 || strings.Trim(s[unit+1:], "0123456789") != "" {
+		return 0, false
+	}
+	next := "s"
+	if s[unit] == 'h' {
+		next = "m"
+	}
+	seconds, _, ok := parseDuration(s + next)
+	return seconds, ok
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in       string
+		seconds  int
+		explicit bool
+		ok       bool
+	}{
+		{"90", 90, false, true},
+		{"1:30", 90, true, true},
+		{"01:02:03", 3723, true, true},
+		{"1m30s", 90, true, true},
+		{"1h2m3s", 3723, true, true},
+		{"1H2M3S", 3723, true, true},
+		{"90sec", 90, true, true},
+		{"2min", 120, true, true},
+		{"2minutes", 120, true, true},
+		{"1hr", 3600, true, true},
+		{"PT1M30S", 90, true, true},
+		{"PT1H", 3600, true, true},
+		{"PT1M30.5S", 90, true, true},
+		{"", 0, false, false},
+		{"-5", 0, false, false},
+		{"1:", 0, false, false},
+		{"1:2:3:4", 0, false, false},
+		{"abc", 0, false, false},
+		{"1m30", 0, false, false},
+		{"24h", 86400, true, true},
+		{"25h", 0, false, false},
+		{"86401", 0, false, false},
+		{"25:00:00", 0, false, false},
+		{"2562047788015216h", 0, false, false},
+		{"99999999999999999999", 0, false, false},
+		{"9999999999999999:00", 0, false, false},
+	}
+	for _, tt := range tests {
+		seconds, explicit, ok := parseDuration(tt.in)
+		if ok != tt.ok || (ok && (seconds != tt.seconds || explicit != tt.explicit)) {
+			t.Errorf("parseDuration(%q) = %d, %t, %t; want %d, %t, %t",
+				tt.in, seconds, explicit, ok, tt.seconds, tt.explicit, tt.ok)
+		}
+	}
+}
+
+func TestTimeRangeFromText(t *testing.T) {
+	tests := []struct {
+		text string
+		want TimeRange
+	}{
+		{"!song at 1m30s", TimeRange{From: 90}},
+		{"!song at 90", TimeRange{From: 90}},
+		{"!song around 2:10", TimeRange{From: 130}},
+		{"!song @ 1:00", TimeRange{From: 60}},
+		{"!song from 2:10 to 2:40", TimeRange{From: 130, To: 160}},
+		{"!song between 1:00 and 1:30", TimeRange{From: 60, To: 90}},
+		{"!song from 30 until 45", TimeRange{From: 30, To: 45}},
+		{"!song from 2:10", TimeRange{From: 130}},
+		{"!song 2:10-2:40", TimeRange{From: 130, To: 160}},
+		{"!song 2:10 - 2:40", TimeRange{From: 130, To: 160}},
+		{"!song 1:00–1:30", TimeRange{From: 60, To: 90}},
+		{"!song 10-20", TimeRange{From: 10, To: 20}},
+		{"!song 10 - 20", TimeRange{From: 10, To: 20}},
+		{"!song at 1:30 not 10-20", TimeRange{From: 90}},
+		{"!song at 2562047788015216h", TimeRange{}},
+		{"!song last 30 seconds", TimeRange{FromEnd: true, Last: 30}},
+		{"!song the last 1 min", TimeRange{FromEnd: true, Last: 60}},
+		{"!song final 45s", TimeRange{FromEnd: true, Last: 45}},
+		{"!song at the end", TimeRange{FromEnd: true}},
+		{"whats the song at the ending?", TimeRange{FromEnd: true}},
+		{"!song 1:30", TimeRange{From: 90}},
+		{"!song 1m30s", TimeRange{From: 90}},
+		{"!song at PT1M30S", TimeRange{From: 90}},
+		{"!song at 1h2m3s", TimeRange{From: 3723}},
+		// A time with a keyword is preferred to one without it
+		{"!song 0:10 no wait, at 1:30", TimeRange{From: 90}},
+		// Single units and plain numbers are only times after keywords
+		{"!song in the 90s", TimeRange{}},
+		{"!song 5m views", TimeRange{}},
+		{"!song 2 3", TimeRange{}},
+		// The end has to be after the start
+		{"!song 20-10", TimeRange{}},
+		{"!song from 2:40 to 2:10", TimeRange{From: 160}},
+		{"!song", TimeRange{}},
+	}
+	for _, tt := range tests {
+		if got := TimeRangeFromText(tt.text); got != tt.want {
+			t.Errorf("TimeRangeFromText(%q) = %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestTimeRangeFromLink(t *testing.T) {
+	tests := []struct {
+		link string
+		want TimeRange
+	}{
+		{"https://youtu.be/dQw4w9WgXcQ?t=90", TimeRange{From: 90}},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=90s", TimeRange{From: 90}},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=1m30s", TimeRange{From: 90}},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=1m30", TimeRange{From: 90}},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=1h30", TimeRange{From: 5400}},
+		{"https://www.twitch.tv/videos/123?t=1h2m3s", TimeRange{From: 3723}},
+		{"https://www.twitch.tv/videos/123?t=01h02m03s", TimeRange{From: 3723}},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&time_continue=45", TimeRange{From: 45}},
+		{"https://www.youtube.com/embed/dQw4w9WgXcQ?start=30", TimeRange{From: 30}},
+		{"https://example.com/video.mp4#t=90", TimeRange{From: 90}},
+		{"https://example.com/video.mp4#t=90,120", TimeRange{From: 90, To: 120}},
+		{"https://example.com/video.mp4#t=1:30,2:00", TimeRange{From: 90, To: 120}},
+		{"https://example.com/video.mp4#t=90,60", TimeRange{From: 90}},
+		{"https://example.com/video.mp4?t=PT1M30S", TimeRange{From: 90}},
+		{"https://example.com/video.mp4?t=0", TimeRange{}},
+		{"https://example.com/video.mp4?t=abc", TimeRange{}},
+		{"https://example.com/video.mp4", TimeRange{}},
+		{"https://example.com/stream.m3u8", TimeRange{}},
+	}
+	for _, tt := range tests {
+		if got := TimeRangeFromLink(tt.link); got != tt.want {
+			t.Errorf("TimeRangeFromLink(%q) = %+v, want %+v", tt.link, got, tt.want)
+		}
+	}
+}
+
+func TestRecognitionParameters(t *testing.T) {
+	tests := []struct {
+		link, text   string
+		skip, limit  string
+		reversed, at string
+	}{
+		{"https://example.com/video.mp4", "!song", "0", "2", "false", "00:00-00:24"},
+		{"https://media.discordapp.net/attachments/1/2/video.mp4", "!song", "0", "3", "false", "00:00-00:36"},
+		{"https://example.com/video.mp4", "!song at 1m30s", "90", "2", "false", "01:30-01:54"},
+		// The middle of a long range is recognized
+		{"https://example.com/video.mp4", "!song from 2:10 to 3:10", "148", "2", "false", "02:28-02:52"},
+		{"https://example.com/video.mp4", "!song from 2:10 to 2:20", "130", "2", "false", "02:10-02:34"},
+		{"https://example.com/video.mp4", "!song last 30 seconds", "0", "3", "true", "the last 36 seconds"},
+		{"https://example.com/video.mp4", "!song last 10 minutes", "0", "5", "true", "the last 60 seconds"},
+		{"https://example.com/video.mp4", "!song at the end", "0", "2", "true", "the end"},
+		{"https://www.twitch.tv/videos/123?t=1h2m3s", "!song", "3723", "2", "false", "01:02:03-01:02:27"},
+		// The time in the link is used before the time in the text
+		{"https://example.com/video.mp4#t=90", "!song at 0:10", "90", "2", "false", "01:30-01:54"},
+	}
+	for _, tt := range tests {
+		parameters, at := recognitionParameters(tt.link, requestedTimeRange(tt.link, tt.text, nil))
+		if parameters["skip_first_seconds"] != tt.skip || parameters["limit"] != tt.limit ||
+			parameters["reversed_order"] != tt.reversed || at != tt.at {
+			t.Errorf("recognitionParameters for %q, %q = %v, %q; want skip %s, limit %s, reversed %s, %q",
+				tt.link, tt.text, parameters, at, tt.skip, tt.limit, tt.reversed, tt.at)
+		}
+	}
+}
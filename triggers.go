@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Mihonarium/discordgo"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// TriggerRule is a phrase the bot reacts to (or, in AntiTriggers, the phrase that stops it from reacting).
+// In the config, it's either a string, which is matched as a substring, or an object with the options.
+// The messages are lowercased, apostrophes are removed, and "what is" is replaced with "whats" before matching
+type TriggerRule struct {
+	Pattern string `json:"pattern"`
+	// Regex makes Pattern a regular expression
+	Regex bool `json:"regex,omitempty"`
+	// WordBoundary only matches Pattern as whole words, so "!song" doesn't match "!songs"
+	WordBoundary bool `json:"word_boundary,omitempty"`
+	// Language limits the rule to the servers with this preferred locale, e.g., "en" or "pt-BR"
+	Language string `json:"language,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (r *TriggerRule) UnmarshalJSON(b []byte) error {
+	var pattern string
+	if err := json.Unmarshal(b, &pattern); err == nil {
+		*r = TriggerRule{Pattern: pattern}
+		return r.compile()
+	}
+	// The type prevents UnmarshalJSON from calling itself
+	type rule TriggerRule
+	if err := json.Unmarshal(b, (*rule)(r)); err != nil {
+		return err
+	}
+	return r.compile()
+}
+
+// MarshalJSON keeps plain phrases as strings
+func (r TriggerRule) MarshalJSON() ([]byte, error) {
+	if !r.Regex && !r.WordBoundary && r.Language == "" {
+		return json.Marshal(r.Pattern)
+	}
+	type rule TriggerRule
+	return json.Marshal(rule(r))
+}
+
+func (r *TriggerRule) compile() error {
+	if r.Pattern == "" {
+		return fmt.Errorf("the trigger pattern is empty")
+	}
+	if !r.Regex && !r.WordBoundary {
+		r.re = nil
+		return nil
+	}
+	pattern := r.Pattern
+	if !r.Regex {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if r.WordBoundary {
+		// \b doesn't work next to non-word characters like ! in "!song"
+		pattern = `(?:^|\W)(?:` + pattern + `)(?:\W|$)`
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return fmt.Errorf("can't compile the trigger %s: %v", r.Pattern, err)
+	}
+	r.re = re
+	return nil
+}
+
+// Match checks the message prepared with getBodyToCompare
+func (r TriggerRule) Match(compare, locale string) bool {
+	return r.Index(compare, locale) >= 0
+}
+
+// Index returns the position of the first match in the message prepared with getBodyToCompare, or -1
+func (r TriggerRule) Index(compare, locale string) int {
+	start, _ := r.find(compare, locale)
+	return start
+}
+
+// find returns the positions of the start and the end of the first match, or -1, -1
+func (r TriggerRule) find(compare, locale string) (int, int) {
+	if r.Language != "" && locale != "" &&
+		!strings.HasPrefix(strings.ToLower(locale), strings.ToLower(r.Language)) {
+		return -1, -1
+	}
+	if r.re == nil && (r.Regex || r.WordBoundary) {
+		// Not compiled, e.g., created without UnmarshalJSON
+		if capture(r.compile()) {
+			return -1, -1
+		}
+	}
+	if r.re != nil {
+		loc := r.re.FindStringIndex(compare)
+		if loc == nil {
+			return -1, -1
+		}
+		return loc[0], loc[1]
+	}
+	start := strings.Index(compare, r.Pattern)
+	if start < 0 {
+		return -1, -1
+	}
+	return start, start + len(r.Pattern)
+}
+
+func (r TriggerRule) String() string {
+	var options []string
+	if r.Regex {
+		options = append(options, "regex")
+	}
+	if r.WordBoundary {
+		options = append(options, "whole words")
+	}
+	if r.Language != "" {
+		options = append(options, r.Language)
+	}
+	if len(options) == 0 {
+		return "`" + r.Pattern + "`"
+	}
+	return "`" + r.Pattern + "` (" + strings.Join(options, ", ") + ")"
+}
+
+// matchTriggers returns the first rule matching the message
+func matchTriggers(compare, locale string, rules []TriggerRule) (bool, TriggerRule) {
+	for _, rule := range rules {
+		if rule.Match(compare, locale) {
+			return true, rule
+		}
+	}
+	return false, TriggerRule{}
+}
+
+func triggerIndex(rules []TriggerRule, pattern string) int {
+	for i, rule := range rules {
+		if rule.Pattern == pattern {
+			return i
+		}
+	}
+	return -1
+}
+
+// TriggerDecision is whether the bot should react to a message and why
+type TriggerDecision struct {
+	Respond bool
+	// Quiet means the message might not be addressed to the bot, so it should only reply if it finds something to
+	// recognize, and not with an explanation of how to use it
+	Quiet   bool
+	Reason  string
+	Trigger TriggerRule
+}
+
+// evaluateTrigger decides whether to react to the message. A trigger at the start of the message, in a reply,
+// or next to media or a mention most likely asks the bot to identify a song; a trigger somewhere in the middle
+// of a long message is more likely a part of a conversation. In messages longer than MaxTriggerTextLength, only
+// a trigger at the start counts, and the bot only replies if it finds something to recognize
+func (c *BotConfig) evaluateTrigger(m *discordgo.Message, locale string) TriggerDecision {
+	compare := getBodyToCompare(m.Content)
+	var d TriggerDecision
+	index := -1
+	for _, rule := range c.Triggers {
+		if index = rule.Index(compare, locale); index >= 0 {
+			d.Trigger = rule
+			break
+		}
+	}
+	if index < 0 {
+		d.Reason = "no trigger"
+		return d
+	}
+	if suppressed, antiTrigger := matchTriggers(compare, locale, c.AntiTriggers); suppressed {
+		d.Reason = fmt.Sprintf("%s matched the anti-trigger %s", d.Trigger, antiTrigger)
+		return d
+	}
+	atStart := strings.TrimSpace(compare[:index]) == ""
+	length := utf8.RuneCountInString(m.Content)
+	long := c.MaxTriggerTextLength > 0 && length > c.MaxTriggerTextLength
+	if long && !atStart {
+		d.Reason = fmt.Sprintf("%s is in a %d-character message, longer than %d, and not at its start",
+			d.Trigger, length, c.MaxTriggerTextLength)
+		return d
+	}
+	d.Respond = true
+	switch {
+	case atStart && long:
+		d.Quiet = true
+		d.Reason = fmt.Sprintf("%s is at the start of a %d-character message, longer than %d; only replying with a result",
+			d.Trigger, length, c.MaxTriggerTextLength)
+	case atStart:
+		d.Reason = fmt.Sprintf("%s is at the start of the message", d.Trigger)
+	case m.Type == discordgo.MessageTypeReply && m.MessageReference != nil:
+		d.Reason = fmt.Sprintf("%s is in a reply", d.Trigger)
+	case len(linksFromMessage(m)) > 0 || len(m.Embeds) > 0:
+		d.Reason = fmt.Sprintf("%s is in a message with media", d.Trigger)
+	case len(m.Mentions) > 0:
+		d.Reason = fmt.Sprintf("%s is in a message with a mention", d.Trigger)
+	case strings.Count(compare, " ") > strings.Count(d.Trigger.Pattern, " ")+2:
+		d.Quiet = true
+		d.Reason = fmt.Sprintf("%s is in the middle of a longer message; only replying with a result", d.Trigger)
+	default:
+		d.Reason = fmt.Sprintf("%s is in a short message", d.Trigger)
+	}
+	return d
+}
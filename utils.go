@@ -39,36 +39,76 @@ func linksFromMessage(m *discordgo.Message) []string {
 		}
 		links = append(links, plaintextUrls[i])
 	}
+	// Other bots often post media only as embeds; link previews of the URLs above are skipped
+	for _, e := range m.Embeds {
+		link := embedMediaLink(e)
+		if link == "" {
+			continue
+		}
+		duplicate := false
+		for _, l := range links {
+			duplicate = duplicate || sameMedia(l, link)
+		}
+		if !duplicate {
+			links = append(links, link)
+		}
+	}
 	return links
 }
 
-func GetTimeFromText(s string) (timeFrom, timeTo int) {
-	s = strings.ReplaceAll(s, " - ", "")
-	words := strings.Split(s, " ")
-	maxScore := 0
-	for _, w := range words {
-		score := 0
-		w2 := ""
-		if strings.Contains(w, "-") {
-			w2 = strings.Split(w, "-")[1]
-			w = strings.Split(w, "-")[0]
-			score += 1
-		}
-		w = strings.TrimSuffix(w, "s")
-		w2 = strings.TrimSuffix(w2, "s")
-		if strings.Contains(w, ":") {
-			score += 2
-		}
-		if score > maxScore {
-			t, err := TimeStringToSeconds(w)
-			if err == nil {
-				timeFrom = t
-				timeTo, _ = TimeStringToSeconds(w2) // if w2 is empty or not a correct time, timeTo is 0
-				maxScore = score
+// sameMedia returns whether the links point to the same file or video, e.g., a youtu.be link and the YouTube video
+// page in its preview
+func sameMedia(a, b string) bool {
+	if normalizeURL(a) == normalizeURL(b) {
+		return true
+	}
+	id := youtubeVideoID(a)
+	return id != "" && id == youtubeVideoID(b)
+}
+
+// youtubeVideoID returns the ID of the video from a YouTube link, or an empty string
+func youtubeVideoID(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	path := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch {
+	case host == "youtu.be":
+		return path[0]
+	case host != "youtube.com" && host != "m.youtube.com" && host != "music.youtube.com":
+		return ""
+	case path[0] == "watch":
+		return u.Query().Get("v")
+	case len(path) == 2 && (path[0] == "shorts" || path[0] == "embed" || path[0] == "live"):
+		return path[1]
+	}
+	return ""
+}
+
+var mediaExtensions = []string{".mp3", ".ogg", ".oga", ".opus", ".wav", ".flac", ".m4a", ".aac", ".mp4", ".webm", ".mov", ".mkv"}
+
+// embedMediaLink returns the link to the video or audio from the embed, or an empty string
+func embedMediaLink(e *discordgo.MessageEmbed) string {
+	if e == nil {
+		return ""
+	}
+	// Video pages, e.g., from YouTube, have their own URL as the embed URL and a player as the video URL
+	if e.Type == discordgo.EmbedTypeVideo && e.URL != "" {
+		return e.URL
+	}
+	if e.Video != nil && e.Video.URL != "" {
+		return e.Video.URL
+	}
+	if u, err := url.Parse(e.URL); err == nil && e.URL != "" {
+		for _, extension := range mediaExtensions {
+			if strings.HasSuffix(strings.ToLower(u.Path), extension) {
+				return e.URL
 			}
 		}
 	}
-	return
+	return ""
 }
 
 func TimeStringToSeconds(s string) (int, error) {
@@ -94,52 +134,6 @@ func SecondsToTimeString(i int, includeHours bool) string {
 	return fmt.Sprintf("%02d:%02d", i/60, i%60)
 }
 
-func GetSkipFirstFromLink(link string) int {
-	skip := 0
-	if strings.HasSuffix(link, ".m3u8") {
-		return skip
-	}
-	u, err := url.Parse(link)
-	if err == nil {
-		t := u.Query().Get("t")
-		if t == "" {
-			t = u.Query().Get("time_continue")
-			if t == "" {
-				t = u.Query().Get("start")
-			}
-		}
-		if t != "" {
-			t = strings.ToLower(strings.ReplaceAll(t, "s", ""))
-			tInt := 0
-			if strings.Contains(t, "m") {
-				s := strings.Split(t, "m")
-				tsInt, _ := strconv.Atoi(s[1])
-				tInt += tsInt
-				if strings.Contains(s[0], "h") {
-					s := strings.Split(s[0], "h")
-					if tmInt, err := strconv.Atoi(s[1]); !capture(err) {
-						tInt += tmInt * 60
-					}
-					if thInt, err := strconv.Atoi(s[0]); !capture(err) {
-						tInt += thInt * 60 * 60
-					}
-				} else {
-					if tmInt, err := strconv.Atoi(s[0]); !capture(err) {
-						tInt += tmInt * 60
-					}
-				}
-			} else {
-				if tsInt, err := strconv.Atoi(t); !capture(err) {
-					tInt = tsInt
-				}
-			}
-			skip += tInt
-			fmt.Println("skip:", skip)
-		}
-	}
-	return skip
-}
-
 func stringInSlice(slice []string, s string) bool {
 	for i := range slice {
 		if s == slice[i] {
@@ -149,15 +143,6 @@ func stringInSlice(slice []string, s string) bool {
 	return false
 }
 
-func substringInSlice(s string, slice []string) (exists bool, substring string) {
-	for i := range slice {
-		if strings.Contains(s, slice[i]) {
-			return true, slice[i]
-		}
-	}
-	return
-}
-
 func filterFrames(frames []sentry.Frame) []sentry.Frame {
 	if len(frames) == 0 {
 		return nil
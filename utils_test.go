@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/Mihonarium/discordgo"
+	"strings"
+	"testing"
+)
+
+func TestYoutubeVideoID(t *testing.T) {
+	tests := []struct {
+		link, want string
+	}{
+		{"https://youtu.be/dQw4w9WgXcQ", "dQw4w9WgXcQ"},
+		{"https://youtu.be/dQw4w9WgXcQ?t=90", "dQw4w9WgXcQ"},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=90s", "dQw4w9WgXcQ"},
+		{"https://m.youtube.com/watch?v=dQw4w9WgXcQ", "dQw4w9WgXcQ"},
+		{"https://music.youtube.com/watch?v=dQw4w9WgXcQ", "dQw4w9WgXcQ"},
+		{"https://www.youtube.com/shorts/dQw4w9WgXcQ", "dQw4w9WgXcQ"},
+		{"https://www.youtube.com/embed/dQw4w9WgXcQ?start=30", "dQw4w9WgXcQ"},
+		{"https://www.youtube.com/live/dQw4w9WgXcQ", "dQw4w9WgXcQ"},
+		{"https://www.youtube.com/@channel", ""},
+		{"https://www.youtube.com/", ""},
+		{"https://example.com/watch?v=dQw4w9WgXcQ", ""},
+	}
+	for _, tt := range tests {
+		if got := youtubeVideoID(tt.link); got != tt.want {
+			t.Errorf("youtubeVideoID(%q) = %q, want %q", tt.link, got, tt.want)
+		}
+	}
+}
+
+func TestLinksFromMessage(t *testing.T) {
+	video := func(link string) *discordgo.MessageEmbed {
+		return &discordgo.MessageEmbed{Type: discordgo.EmbedTypeVideo, URL: link}
+	}
+	tests := []struct {
+		name    string
+		content string
+		embeds  []*discordgo.MessageEmbed
+		want    []string
+	}{
+		{"a link", "!song https://example.com/clip.mp4", nil, []string{"https://example.com/clip.mp4"}},
+		{"the preview of a link", "!song https://example.com/clip.mp4",
+			[]*discordgo.MessageEmbed{video("https://example.com/clip.mp4")}, []string{"https://example.com/clip.mp4"}},
+		{"the preview of a youtu.be link", "!song https://youtu.be/abc",
+			[]*discordgo.MessageEmbed{video("https://www.youtube.com/watch?v=abc")}, []string{"https://youtu.be/abc"}},
+		{"the preview of a YouTube short", "!song https://youtube.com/shorts/abc?si=123",
+			[]*discordgo.MessageEmbed{video("https://www.youtube.com/watch?v=abc")},
+			[]string{"https://youtube.com/shorts/abc?si=123"}},
+		{"another YouTube video", "!song https://youtu.be/abc",
+			[]*discordgo.MessageEmbed{video("https://www.youtube.com/watch?v=def")},
+			[]string{"https://youtu.be/abc", "https://www.youtube.com/watch?v=def"}},
+		{"an embed without a link", "!song",
+			[]*discordgo.MessageEmbed{video("https://www.youtube.com/watch?v=abc")},
+			[]string{"https://www.youtube.com/watch?v=abc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testMessage("1", tt.content)
+			m.Embeds = tt.embeds
+			if got := linksFromMessage(m); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
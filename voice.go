@@ -4,23 +4,23 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"github.com/Mihonarium/dgvoice"
 	"github.com/Mihonarium/discordgo"
 	"github.com/cryptix/wav"
 	"github.com/orcaman/writerseeker"
 	"io"
+	"math"
 	"sync"
 	"time"
 )
 
-func CreateAndStartBuffer(s *discordgo.Session, guildID, channelID, initiatedByUserID string) error {
+func CreateAndStartBuffer(s Session, guildID, channelID, initiatedByUserID string, seconds int) error {
 	mu.Lock()
 	existedBuf, alreadySet := serverBuffers[guildID+"-"+channelID]
 	if alreadySet {
 		existedBuf.Stop()
 		delete(serverBuffers, guildID+"-"+channelID)
 	}
-	buf, err := startBuffer(s, guildID, channelID, initiatedByUserID)
+	buf, err := startBuffer(s, guildID, channelID, initiatedByUserID, seconds)
 	if err != nil {
 		mu.Unlock()
 		return err
@@ -38,82 +38,219 @@ func StopBuffer(guildID, channelID string) {
 	delete(serverBuffers, guildID+"-"+channelID)
 	mu.Unlock()
 }
-func startBuffer(s *discordgo.Session, guildID, channelID, initiatedByUserID string) (serverBuffer, error) {
+func startBuffer(s Session, guildID, channelID, initiatedByUserID string, seconds int) (serverBuffer, error) {
 	vc, err := s.ChannelVoiceJoin(guildID, channelID, true, false, &h)
 	if err != nil {
 		return serverBuffer{}, err
 	}
-	recv := make(chan *discordgo.Packet, 2)
-	go dgvoice.ReceivePCM(vc, recv)
-
-	onClose := func() {
+	recv, err := opusReceiver(vc)
+	if err != nil {
 		capture(vc.Disconnect())
+		return serverBuffer{}, err
 	}
+	ring := NewVoiceRing(seconds)
+	stop := make(chan struct{})
+	go func() {
+		defer captureFunc(vc.Disconnect)
+		for {
+			select {
+			case <-stop:
+				return
+			case p, ok := <-recv:
+				if !ok {
+					return
+				}
+				ring.Add(p)
+			}
+		}
+	}()
+	once := &sync.Once{}
+	return serverBuffer{
+		ring:            ring,
+		stop:            func() { once.Do(func() { close(stop) }) },
+		InitiatedByUser: initiatedByUserID,
+	}, nil
+}
 
-	audioBuf, started, stop := listenBuffer(recv, time.Second*time.Duration(RecordSeconds), onClose)
-	return serverBuffer{buf: audioBuf, start: started, stop: stop, InitiatedByUser: initiatedByUserID}, nil
+// opusReceiver returns the channel with Opus packets received from the voice channel. The packets aren't decoded
+// until they're needed, so listening doesn't use much CPU
+func opusReceiver(vc *discordgo.VoiceConnection) (chan *discordgo.Packet, error) {
+	vc.RLock()
+	recv := vc.OpusRecv
+	vc.RUnlock()
+	if recv == nil {
+		return nil, fmt.Errorf("the voice connection isn't receiving audio")
+	}
+	return recv, nil
 }
 
-const RecordSeconds = 12
+const (
+	MinRecordSeconds = 5
+	MaxRecordSeconds = 60
+)
 
-func exitStreamsOnMute(alreadyCancelled *bool, cancelMu *sync.Mutex, recv chan *discordgo.Packet) {
-	sleepBeforeCheckingForMute := 5
-	time.Sleep(time.Second * time.Duration(sleepBeforeCheckingForMute))
-	cancelMu.Lock()
-	if *alreadyCancelled {
-		return
+// If nothing is received during this time, the voice channel is considered muted
+const muteCheckSeconds = 5
+
+func (c *BotConfig) recordSound(s Session, guildID, channelID, userToListenToID, mode string, seconds int) ([]byte, error) {
+	vc, err := s.ChannelVoiceJoin(guildID, channelID, true, false, &h)
+	if err != nil {
+		return nil, err
 	}
-	select {
-	case recv <- &discordgo.Packet{
-		Type: []byte("mute-check"),
-	}:
-	default:
+	defer captureFunc(vc.Disconnect)
+	recv, err := opusReceiver(vc)
+	if err != nil {
+		return nil, err
 	}
-	cancelMu.Unlock()
-	time.Sleep(time.Second * time.Duration(RecordSeconds-sleepBeforeCheckingForMute+2))
-	cancelMu.Lock()
-	if *alreadyCancelled {
-		return
+	ring := NewVoiceRing(seconds)
+	muteCheck := time.After(time.Second * muteCheckSeconds)
+	done := time.After(time.Second * time.Duration(seconds))
+	for recording := true; recording; {
+		select {
+		case p, ok := <-recv:
+			if !ok {
+				recording = false
+				break
+			}
+			ring.Add(p)
+		case <-muteCheck:
+			// Exit if the voice channel was mute
+			if ring.Received() == 0 {
+				return nil, nil
+			}
+		case <-done:
+			recording = false
+		}
 	}
-	select {
-	case recv <- &discordgo.Packet{
-		Type: []byte("check-exit"),
-	}:
-	default:
+	return getWavAudio(ring, userToListenToID, mode, seconds)
+}
+
+// Ways to pick the audio when no speaker is specified
+const (
+	SpeakerModeAuto    = "auto"
+	SpeakerModeMix     = "mix"
+	SpeakerModeLoudest = "loudest"
+)
+
+func getWavAudio(ring *VoiceRing, userToListenToID, mode string, seconds int) ([]byte, error) {
+	var resultPCM []int16
+	if userToListenToID != "" {
+		frames := ring.Frames(userToListenToID, seconds)
+		decoded, err := decodeFrames(frames)
+		if err != nil {
+			return nil, err
+		}
+		resultPCM = assemblePCM(frames, decoded)
+	} else {
+		streams := ring.Streams(seconds)
+		switch mode {
+		case SpeakerModeLoudest:
+			resultPCM = loudestStream(streams)
+		case SpeakerModeMix:
+			resultPCM = mixStreams(streams)
+		default:
+			resultPCM = mostMusicalStream(streams)
+			if resultPCM == nil {
+				resultPCM = mixStreams(streams)
+			}
+		}
+		resultPCM = trimSilence(resultPCM)
+	}
+	if len(resultPCM) == 0 {
+		return nil, nil
 	}
-	cancelMu.Unlock()
+	return encodeWav(resultPCM)
+}
+
+// A pause in transmission longer than this is shortened, since there's no audio in it anyway
+const maxPauseSamples = 48000
 
+// assemblePCM joins the decoded frames of a speaker into mono audio, inserting silence where packets were lost
+func assemblePCM(frames []voiceFrame, decoded [][]int16) []int16 {
+	pcm := make([]int16, 0, len(frames)*frameSamples)
+	for i, frame := range frames {
+		if i > 0 {
+			prev := frames[i-1]
+			missing := int(frame.Timestamp-prev.Timestamp) - frameSamples
+			if missing > 0 {
+				if frame.Sequence-prev.Sequence == 1 {
+					// Consecutive packets with a gap between the timestamps mean the speaker stopped transmitting
+					// rather than that packets were lost
+					if missing > maxPauseSamples {
+						missing = maxPauseSamples
+					}
+				}
+				pcm = append(pcm, make([]int16, missing)...)
+			}
+		}
+		mono := convertPCMToMono(decoded[i])
+		if len(mono) == 0 {
+			mono = make([]int16, frameSamples)
+		}
+		pcm = append(pcm, mono...)
+	}
+	return pcm
 }
 
-func (c *BotConfig) recordSound(s *discordgo.Session, guildID, channelID, userToListenToID string) ([]byte, error) {
-	vc, err := s.ChannelVoiceJoin(guildID, channelID, true, false, &h)
-	if err != nil {
-		return nil, err
+// mixStreams sums the streams and scales the result down if it would clip
+func mixStreams(streams []speakerStream) []int16 {
+	if len(streams) == 0 {
+		return nil
 	}
-	cancelled := false
-	cancelMu := &sync.Mutex{}
-	defer func() {
-		cancelMu.Lock()
-		cancelled = true
-		cancelMu.Unlock()
-		capture(vc.Disconnect())
-	}()
-	recv := make(chan *discordgo.Packet, 2)
-	go dgvoice.ReceivePCM(vc, recv)
-	go exitStreamsOnMute(&cancelled, cancelMu, recv)
-	// out, err := os.Create("output.pcm")
-	if err != nil {
-		return nil, err
+	sum := make([]int32, len(streams[0].PCM))
+	peak := int32(math.MaxInt16)
+	for _, stream := range streams {
+		for i, sample := range stream.PCM {
+			sum[i] += int32(sample)
+			if sum[i] > peak {
+				peak = sum[i]
+			} else if -sum[i] > peak {
+				peak = -sum[i]
+			}
+		}
 	}
-	// defer captureFunc(out.Close)
-	audioBuf, err := getWavAudio(recv, false, userToListenToID)
-	if err != nil {
-		return nil, err
+	mixed := make([]int16, len(sum))
+	for i := range sum {
+		mixed[i] = int16(int64(sum[i]) * math.MaxInt16 / int64(peak))
+	}
+	return mixed
+}
+
+func loudestStream(streams []speakerStream) []int16 {
+	var loudest []int16
+	maxRMS := 0.0
+	for _, stream := range streams {
+		if v := rms(stream.PCM); v > maxRMS {
+			maxRMS = v
+			loudest = stream.PCM
+		}
+	}
+	return loudest
+}
+
+func rms(pcm []int16) float64 {
+	if len(pcm) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, sample := range pcm {
+		sum += float64(sample) * float64(sample)
+	}
+	return math.Sqrt(sum / float64(len(pcm)))
+}
+
+func trimSilence(pcm []int16) []int16 {
+	start, end := 0, len(pcm)
+	for start < end && pcm[start] == 0 {
+		start++
 	}
-	return audioBuf, nil
+	for end > start && pcm[end-1] == 0 {
+		end--
+	}
+	return pcm[start:end]
 }
 
-func getWavAudio(in chan *discordgo.Packet, readAll bool, userToListenToID string) ([]byte, error) {
+func encodeWav(pcm []int16) ([]byte, error) {
 	file := wav.File{
 		SampleRate:      48000,
 		SignificantBits: 16,
@@ -124,59 +261,10 @@ func getWavAudio(in chan *discordgo.Packet, readAll bool, userToListenToID strin
 	if err != nil {
 		return nil, err
 	}
-	start := time.Now()
-	count := 0
-	PCMStreams := make(map[string][]int16)
-	for f := range in {
-		if bytes.Equal(f.Type, []byte("mute-check")) {
-			// Exit if the voice channel was mute
-			if count == 0 {
-				break
-			}
-			continue
-		}
-		if bytes.Equal(f.Type, []byte("stream-stop")) {
-			break
-		}
-		if bytes.Equal(f.Type, []byte("check-exit")) {
-			// So we can exit even if the voice channel has no sound after RecordSeconds seconds
-			break
-		}
-		count++
-		u := checkSSRC(f.SSRC)
-		if u == "" {
-			fmt.Println("Can't get a user for SSRC", f.SSRC)
-			continue
-		}
-		int16Slice := convertPCMToMono(f.PCM)
-		if PCMStreams[u] == nil {
-			PCMStreams[u] = make([]int16, 0)
-		}
-		PCMStreams[u] = append(PCMStreams[u], int16Slice...)
-		// PCMStreams[u] = append(PCMStreams[u], f.PCM...)
-		if !readAll {
-			if start.Add(time.Second * time.Duration(RecordSeconds)).Before(time.Now()) {
-				break
-			}
-		}
-	}
-	if count == 0 {
-		return nil, nil
-	}
-	resultPCM := make([]int16, len(PCMStreams[userToListenToID]))
-	for j := range PCMStreams[userToListenToID] {
-		resultPCM[j] += PCMStreams[userToListenToID][j]
-	}
-	for i := 0; i < len(resultPCM); i++ {
-		buf := new(bytes.Buffer)
-		err := binary.Write(buf, binary.LittleEndian, resultPCM[i])
-		if err != nil {
-			return nil, err
-		}
-		bytes_ := buf.Bytes()
-		var byteSlice []byte
-		byteSlice = append(byteSlice, bytes_[0], bytes_[1])
-		err = writer.WriteSample(byteSlice)
+	sample := make([]byte, 2)
+	for i := range pcm {
+		binary.LittleEndian.PutUint16(sample, uint16(pcm[i]))
+		err = writer.WriteSample(sample)
 		if err != nil {
 			return nil, err
 		}
@@ -190,82 +278,10 @@ func getWavAudio(in chan *discordgo.Packet, readAll bool, userToListenToID strin
 	return bytesBuf.Bytes(), nil
 }
 
-func listenBuffer(in chan *discordgo.Packet, size time.Duration, onClose func()) (audioBuffer chan *discordgo.Packet, started, stop chan struct{}) {
-	started = make(chan struct{}, 2)
-	stop = make(chan struct{}, 4)
-	audioBuffer = make(chan *discordgo.Packet, 50000)
-	cancelMu := &sync.Mutex{}
-	cancelled := false
-	go func() {
-		// Added this so if there's no sound, the bot leaves the VC immediately without waiting for a packet
-		<-stop
-		in <- &discordgo.Packet{
-			Type: []byte("stream-stop"),
-		}
-		// If there are a lot of packets in the queue,
-		// this guarantees that the bot will leave after it's done with the current packet
-		stop <- struct{}{}
-	}()
-	go func() {
-		defer onClose()
-		buffered := false
-		var ticker *time.Ticker
-		isStarted := false
-		for f := range in {
-			select {
-			case <-stop:
-				cancelMu.Lock()
-				cancelled = true
-				cancelMu.Unlock()
-				close(audioBuffer)
-				stop <- struct{}{}
-				return
-			case <-started:
-				isStarted = true
-				go exitStreamsOnMute(&cancelled, cancelMu, audioBuffer)
-			default:
-			}
-			if bytes.Equal(f.Type, []byte("stream-stop")) {
-				cancelMu.Lock()
-				cancelled = true
-				cancelMu.Unlock()
-				close(audioBuffer)
-				return
-			}
-			if ticker == nil {
-				ticker = time.NewTicker(size)
-			}
-			if !buffered {
-				select {
-				case <-ticker.C:
-					buffered = true
-					ticker.Stop()
-				default:
-					audioBuffer <- f
-				}
-			}
-			if buffered && !isStarted {
-				<-audioBuffer
-				audioBuffer <- f
-			}
-			if isStarted && buffered {
-				audioBuffer <- &discordgo.Packet{
-					Type: []byte("stream-stop"),
-				}
-				isStarted = false
-				ticker = nil
-				buffered = false
-			}
-		}
-	}()
-	return audioBuffer, started, stop
-}
-
 func convertPCMToMono(pcm []int16) []int16 {
-	var monoPCM []int16
-	for i := 0; i < len(pcm); i += 2 {
-		sample1 := pcm[i] //+ pcm[i+1]
-		monoPCM = append(monoPCM, sample1)
+	monoPCM := make([]int16, len(pcm)/2)
+	for i := range monoPCM {
+		monoPCM[i] = int16((int32(pcm[2*i]) + int32(pcm[2*i+1])) / 2)
 	}
 	return monoPCM
 }
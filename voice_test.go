@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// sampleRun is a number of equal samples in a row, to compare long PCM by its runs
+type sampleRun struct {
+	Sample int16
+	Count  int
+}
+
+func sampleRuns(pcm []int16) []sampleRun {
+	var runs []sampleRun
+	for _, sample := range pcm {
+		if len(runs) > 0 && runs[len(runs)-1].Sample == sample {
+			runs[len(runs)-1].Count++
+			continue
+		}
+		runs = append(runs, sampleRun{sample, 1})
+	}
+	return runs
+}
+
+func stereoFrame(sample int16) []int16 {
+	pcm := make([]int16, frameSamples*2)
+	for i := range pcm {
+		pcm[i] = sample
+	}
+	return pcm
+}
+
+func TestAssemblePCM(t *testing.T) {
+	tests := []struct {
+		name    string
+		frames  []voiceFrame
+		decoded [][]int16
+		want    []sampleRun
+	}{
+		{"consecutive frames",
+			[]voiceFrame{{Timestamp: 0, Sequence: 1}, {Timestamp: 960, Sequence: 2}},
+			[][]int16{stereoFrame(1), stereoFrame(2)},
+			[]sampleRun{{1, 960}, {2, 960}}},
+		{"a lost packet",
+			[]voiceFrame{{Timestamp: 0, Sequence: 1}, {Timestamp: 2880, Sequence: 3}},
+			[][]int16{stereoFrame(1), stereoFrame(2)},
+			[]sampleRun{{1, 960}, {0, 1920}, {2, 960}}},
+		{"a short pause",
+			[]voiceFrame{{Timestamp: 0, Sequence: 1}, {Timestamp: 960 * 10, Sequence: 2}},
+			[][]int16{stereoFrame(1), stereoFrame(2)},
+			[]sampleRun{{1, 960}, {0, 960 * 9}, {2, 960}}},
+		{"a long pause is shortened",
+			[]voiceFrame{{Timestamp: 0, Sequence: 1}, {Timestamp: 960 * 100, Sequence: 2}},
+			[][]int16{stereoFrame(1), stereoFrame(2)},
+			[]sampleRun{{1, 960}, {0, maxPauseSamples}, {2, 960}}},
+		{"many lost packets are kept as silence",
+			[]voiceFrame{{Timestamp: 0, Sequence: 1}, {Timestamp: 960 * 100, Sequence: 101}},
+			[][]int16{stereoFrame(1), stereoFrame(2)},
+			[]sampleRun{{1, 960}, {0, 960 * 99}, {2, 960}}},
+		{"a broken frame",
+			[]voiceFrame{{Timestamp: 0, Sequence: 1}, {Timestamp: 960, Sequence: 2}, {Timestamp: 1920, Sequence: 3}},
+			[][]int16{stereoFrame(1), nil, stereoFrame(2)},
+			[]sampleRun{{1, 960}, {0, 960}, {2, 960}}},
+		{"the timestamp and the sequence wrap around",
+			[]voiceFrame{{Timestamp: math.MaxUint32 - 959, Sequence: math.MaxUint16}, {Timestamp: 0, Sequence: 0}},
+			[][]int16{stereoFrame(1), stereoFrame(2)},
+			[]sampleRun{{1, 960}, {2, 960}}},
+		{"no frames", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sampleRuns(assemblePCM(tt.frames, tt.decoded))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertPCMToMono(t *testing.T) {
+	tests := []struct {
+		stereo []int16
+		want   []int16
+	}{
+		{[]int16{1, 2}, []int16{1}},
+		{[]int16{-1, -2}, []int16{-1}},
+		{[]int16{100, -100, 0, 50}, []int16{0, 25}},
+		{[]int16{math.MaxInt16, math.MaxInt16}, []int16{math.MaxInt16}},
+		{[]int16{math.MinInt16, math.MinInt16}, []int16{math.MinInt16}},
+		{[]int16{math.MaxInt16, math.MinInt16}, []int16{0}},
+		// A sample without a pair is dropped
+		{[]int16{10, 20, 30}, []int16{15}},
+		{nil, []int16{}},
+	}
+	for _, tt := range tests {
+		got := convertPCMToMono(tt.stereo)
+		if len(got) != len(tt.want) {
+			t.Errorf("convertPCMToMono(%v) = %v, want %v", tt.stereo, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("convertPCMToMono(%v) = %v, want %v", tt.stereo, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMixStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		streams [][]int16
+		want    []int16
+	}{
+		{"a single stream", [][]int16{{100, -100, 0}}, []int16{100, -100, 0}},
+		{"quiet streams are summed", [][]int16{{10000, -10000}, {20000, -20000}}, []int16{30000, -30000}},
+		{"the sum is scaled down to the peak", [][]int16{{20000, 10000}, {20000, -10000}}, []int16{math.MaxInt16, 0}},
+		{"the peak can be negative", [][]int16{{-20000, 10000}, {-20000, 10000}}, []int16{-math.MaxInt16, 16383}},
+		{"the minimum sample", [][]int16{{math.MinInt16}}, []int16{-math.MaxInt16}},
+		{"the loudest of many streams", [][]int16{{math.MaxInt16}, {math.MaxInt16}, {math.MaxInt16}}, []int16{math.MaxInt16}},
+		{"no streams", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streams := make([]speakerStream, 0, len(tt.streams))
+			for _, pcm := range tt.streams {
+				streams = append(streams, speakerStream{PCM: pcm})
+			}
+			got := mixStreams(streams)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoudestStream(t *testing.T) {
+	streams := []speakerStream{
+		{UserID: "quiet", PCM: []int16{100, -100, 100}},
+		{UserID: "loud", PCM: []int16{0, 10000, 0}},
+		{UserID: "silent", PCM: []int16{0, 0, 0}},
+	}
+	if got := loudestStream(streams); len(got) != 3 || got[1] != 10000 {
+		t.Errorf("got %v", got)
+	}
+	if got := loudestStream(streams[2:]); got != nil {
+		t.Errorf("got %v from silence", got)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"github.com/Mihonarium/discordgo"
+	"layeh.com/gopus"
+	"sync"
+	"time"
+)
+
+// Discord sends 20ms Opus frames; the RTP timestamp grows by 960 per frame at 48kHz
+const (
+	frameSamples   = 960
+	framesInSecond = 50
+)
+
+// voiceFrame keeps the Opus data as received; it's only decoded when the audio is needed for a recognition
+type voiceFrame struct {
+	Timestamp uint32
+	Sequence  uint16
+	Received  time.Time
+	Opus      []byte
+}
+
+// speakerBuffer keeps the frames of a single SSRC in slots indexed by the RTP timestamp,
+// so newer frames overwrite the ones that are too old to be read
+type speakerBuffer struct {
+	UserID      string
+	frames      []voiceFrame
+	filled      []bool
+	base        uint32
+	latest      uint32
+	latestSaved bool
+}
+
+func (b *speakerBuffer) slot(timestamp uint32) int {
+	// int32 conversion handles the frames older than the base and the timestamp wrapping around
+	n := int64(len(b.frames))
+	offset := int64(int32(timestamp-b.base)) / frameSamples
+	return int((offset%n + n) % n)
+}
+
+func (b *speakerBuffer) add(frame voiceFrame) {
+	if !b.latestSaved {
+		b.base = frame.Timestamp
+	} else if int64(int32(b.latest-frame.Timestamp)) >= int64(len(b.frames))*frameSamples {
+		// A frame that arrived too late to fit in the buffer would overwrite a newer one
+		return
+	}
+	i := b.slot(frame.Timestamp)
+	b.frames[i] = frame
+	b.filled[i] = true
+	if !b.latestSaved || int32(frame.Timestamp-b.latest) > 0 {
+		b.latest = frame.Timestamp
+		b.latestSaved = true
+	}
+	// Moving the base by whole turns of the buffer keeps the slots and keeps the offsets from overflowing int32
+	if turn := uint32(len(b.frames)) * frameSamples; b.latest-b.base >= 1<<30 {
+		b.base += (b.latest - b.base) / turn * turn
+	}
+}
+
+// frame returns the frame with the timestamp if it's still in the buffer
+func (b *speakerBuffer) frame(timestamp uint32) (voiceFrame, bool) {
+	i := b.slot(timestamp)
+	if !b.filled[i] || b.frames[i].Timestamp != timestamp {
+		return voiceFrame{}, false
+	}
+	return b.frames[i], true
+}
+
+// VoiceRing is a rolling buffer of the audio received from a voice channel. It can be read by several goroutines
+// at the same time while new audio is being added
+type VoiceRing struct {
+	mu       sync.RWMutex
+	speakers map[uint32]*speakerBuffer
+	capacity int
+	received int
+}
+
+func NewVoiceRing(seconds int) *VoiceRing {
+	return &VoiceRing{
+		speakers: map[uint32]*speakerBuffer{},
+		capacity: seconds * framesInSecond,
+	}
+}
+
+func (r *VoiceRing) Add(p *discordgo.Packet) {
+	userID := checkSSRC(p.SSRC)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	speaker, exists := r.speakers[p.SSRC]
+	if !exists {
+		speaker = &speakerBuffer{
+			frames: make([]voiceFrame, r.capacity),
+			filled: make([]bool, r.capacity),
+		}
+		r.speakers[p.SSRC] = speaker
+	}
+	if userID != "" {
+		// The SSRC is removed from usersSSRCs when the user stops speaking, so remembering who it was
+		speaker.UserID = userID
+	}
+	speaker.add(voiceFrame{
+		Timestamp: p.Timestamp,
+		Sequence:  p.Sequence,
+		Received:  time.Now(),
+		Opus:      p.Opus,
+	})
+	r.received++
+}
+
+// Received returns the number of frames added to the buffer
+func (r *VoiceRing) Received() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.received
+}
+
+// Frames returns the user's frames from the last seconds in the order of their timestamps
+func (r *VoiceRing) Frames(userID string, seconds int) []voiceFrame {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var speaker *speakerBuffer
+	for _, b := range r.speakers {
+		if b.UserID != userID || !b.latestSaved {
+			continue
+		}
+		if speaker == nil || latestReceived(b).After(latestReceived(speaker)) {
+			speaker = b
+		}
+	}
+	if speaker == nil {
+		return nil
+	}
+	return speaker.lastFrames(seconds)
+}
+
+func (b *speakerBuffer) lastFrames(seconds int) []voiceFrame {
+	count := seconds * framesInSecond
+	if count > len(b.frames) {
+		count = len(b.frames)
+	}
+	since := time.Now().Add(-time.Second * time.Duration(seconds))
+	frames := make([]voiceFrame, 0, count)
+	first := b.latest - uint32(count-1)*frameSamples
+	for i := 0; i < count; i++ {
+		frame, ok := b.frame(first + uint32(i)*frameSamples)
+		if !ok || frame.Received.Before(since) {
+			continue
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func latestReceived(b *speakerBuffer) time.Time {
+	frame, _ := b.frame(b.latest)
+	return frame.Received
+}
+
+type speakerStream struct {
+	UserID string
+	PCM    []int16
+}
+
+// Streams returns mono audio of every speaker from the last seconds. The streams are aligned by the time the frames were
+// received, since RTP timestamps of different speakers aren't related, and the gaps are filled with silence
+func (r *VoiceRing) Streams(seconds int) []speakerStream {
+	type speakerFrames struct {
+		UserID         string
+		Frames         []voiceFrame
+		Latest         uint32
+		LatestReceived time.Time
+	}
+	// The frames are copied under the lock and decoded after it's released, so Add doesn't wait for the decoding
+	r.mu.RLock()
+	now := time.Now()
+	speakers := make([]speakerFrames, 0, len(r.speakers))
+	for _, b := range r.speakers {
+		if !b.latestSaved {
+			continue
+		}
+		frames := b.lastFrames(seconds)
+		if len(frames) == 0 {
+			continue
+		}
+		speakers = append(speakers, speakerFrames{b.UserID, frames, b.latest, latestReceived(b)})
+	}
+	r.mu.RUnlock()
+
+	window := seconds * 48000
+	streams := make([]speakerStream, 0, len(speakers))
+	for _, b := range speakers {
+		frames := b.Frames
+		decoded, err := decodeFrames(frames)
+		if capture(err) {
+			continue
+		}
+		pcm := make([]int16, window)
+		end := window - int(now.Sub(b.LatestReceived).Seconds()*48000)
+		for i, frame := range frames {
+			pos := end - frameSamples - int(b.Latest-frame.Timestamp)
+			for j, sample := range convertPCMToMono(decoded[i]) {
+				if pos+j >= 0 && pos+j < window {
+					pcm[pos+j] = sample
+				}
+			}
+		}
+		streams = append(streams, speakerStream{UserID: b.UserID, PCM: pcm})
+	}
+	return streams
+}
+
+// decodeFrames decodes the frames of a single speaker to stereo PCM. The frames have to be in order, since
+// the Opus decoder keeps state between them
+func decodeFrames(frames []voiceFrame) ([][]int16, error) {
+	decoder, err := gopus.NewDecoder(48000, 2)
+	if err != nil {
+		return nil, err
+	}
+	decoded := make([][]int16, len(frames))
+	for i, frame := range frames {
+		decoded[i], err = decoder.Decode(frame.Opus, frameSamples, false)
+		if err != nil {
+			// A broken frame is left silent
+			decoded[i] = nil
+		}
+	}
+	return decoded, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/Mihonarium/discordgo"
+	"math"
+	"testing"
+	"time"
+)
+
+func timestamps(frames []voiceFrame) []uint32 {
+	result := make([]uint32, 0, len(frames))
+	for _, frame := range frames {
+		result = append(result, frame.Timestamp)
+	}
+	return result
+}
+
+func equalTimestamps(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSpeakerBuffer(t *testing.T) {
+	const wrap = math.MaxUint32 - 2*frameSamples + 1
+	const long = 2236962 * frameSamples
+	tests := []struct {
+		name       string
+		capacity   int
+		timestamps []uint32
+		want       []uint32
+	}{
+		{"in order", 4, []uint32{0, 960, 1920}, []uint32{0, 960, 1920}},
+		{"reordered", 4, []uint32{0, 1920, 960}, []uint32{0, 960, 1920}},
+		{"older than the first frame", 4, []uint32{1920, 960, 2880}, []uint32{960, 1920, 2880}},
+		{"a lost frame", 4, []uint32{0, 1920}, []uint32{0, 1920}},
+		{"old frames are overwritten", 3, []uint32{0, 960, 1920, 2880, 3840}, []uint32{1920, 2880, 3840}},
+		{"a late frame doesn't overwrite a newer one", 3, []uint32{0, 960, 1920, 2880, 0}, []uint32{960, 1920, 2880}},
+		{"the timestamp wraps around", 4, []uint32{wrap, wrap + 960, 0, 960}, []uint32{wrap, wrap + 960, 0, 960}},
+		{"a frame before the wrap arrives late", 4, []uint32{wrap, 0, wrap + 960}, []uint32{wrap, wrap + 960, 0}},
+		{"a long stream", 4, []uint32{0, long, long + 960, long + 1920}, []uint32{long, long + 960, long + 1920}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &speakerBuffer{frames: make([]voiceFrame, tt.capacity), filled: make([]bool, tt.capacity)}
+			for i, timestamp := range tt.timestamps {
+				b.add(voiceFrame{Timestamp: timestamp, Sequence: uint16(i), Received: time.Now()})
+			}
+			if got := timestamps(b.lastFrames(1)); !equalTimestamps(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpeakerBufferSkipsOldFrames(t *testing.T) {
+	b := &speakerBuffer{frames: make([]voiceFrame, 200), filled: make([]bool, 200)}
+	b.add(voiceFrame{Timestamp: 0, Received: time.Now().Add(-3 * time.Second)})
+	b.add(voiceFrame{Timestamp: 960, Received: time.Now()})
+	if got := timestamps(b.lastFrames(2)); !equalTimestamps(got, []uint32{960}) {
+		t.Errorf("got %v from the last 2 seconds", got)
+	}
+	if got := timestamps(b.lastFrames(4)); !equalTimestamps(got, []uint32{0, 960}) {
+		t.Errorf("got %v from the last 4 seconds", got)
+	}
+}
+
+func TestVoiceRing(t *testing.T) {
+	const ssrc = 42
+	mu.Lock()
+	usersSSRCs[testUserID] = ssrc
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		delete(usersSSRCs, testUserID)
+		mu.Unlock()
+	})
+
+	r := NewVoiceRing(MaxRecordSeconds)
+	frames := MaxRecordSeconds*framesInSecond + 10
+	for i := 0; i < frames; i++ {
+		r.Add(&discordgo.Packet{SSRC: ssrc, Sequence: uint16(i), Timestamp: uint32(i * frameSamples)})
+		if i == frames/2 {
+			// The user is remembered after they stop speaking
+			mu.Lock()
+			delete(usersSSRCs, testUserID)
+			mu.Unlock()
+		}
+	}
+	if r.Received() != frames {
+		t.Errorf("received %d frames, want %d", r.Received(), frames)
+	}
+	got := r.Frames(testUserID, MaxRecordSeconds)
+	if len(got) != MaxRecordSeconds*framesInSecond {
+		t.Fatalf("got %d frames for the longest recording, want %d", len(got), MaxRecordSeconds*framesInSecond)
+	}
+	if first, last := got[0].Timestamp, got[len(got)-1].Timestamp; first != 10*frameSamples ||
+		last != uint32((frames-1)*frameSamples) {
+		t.Errorf("got the frames from %d to %d", first, last)
+	}
+	if got := r.Frames("someone else", MaxRecordSeconds); got != nil {
+		t.Errorf("got %d frames of another user", len(got))
+	}
+}